@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// The most tasks created or looked up in one batch call.
+const maxBatchSize = 1000
+
+// taskStatus is what Statuses answers for every id asked about. State is
+// missing for tasks that don't exist (or were purged).
+type taskStatus struct {
+	Id     task.ID     `json:"id"`
+	State  *task.State `json:"state,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Tenant string      `json:"tenant,omitempty"`
+}
+
+// NewTasks creates a task for every spec in the JSON list in the request
+// body and answers with the list of their ids, in the same order. The specs
+// are checked first; if any of them is wrong no task is created. All tasks
+// are logged at once. "maxTasks" caps the unfinished tasks per tenant, as for
+// NewTask.
+func (h *Handler) NewTasks(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	maxTasks, err := maxTasksFromQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	specs := []task.Task{}
+	if err = json.Unmarshal(data, &specs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(specs) == 0 || len(specs) > maxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: A batch holds between 1 and %v tasks", maxBatchSize)
+		return
+	}
+
+	tasksToAdd := make([]task.Task, len(specs))
+	ids := make([]task.ID, len(specs))
+	newTasks := make(map[string]int)
+	for i, spec := range specs {
+		tasksToAdd[i] = spec.Spec()
+		if err = tasksToAdd[i].ValidateSpec(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: Task %v: %v", i, err)
+			return
+		}
+		if len(tasksToAdd[i].IdempotencyKey) != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: Task %v: Idempotency keys aren't supported in batches", i)
+			return
+		}
+		tasksToAdd[i].Id = task.NewID()
+		ids[i] = tasksToAdd[i].Id
+		newTasks[tasksToAdd[i].Tenant]++
+	}
+
+	var dependencyErr error
+	datastoreMutex.Lock()
+	limitErr := checkTaskLimit(newTasks, maxTasks)
+	for i := range tasksToAdd {
+		if limitErr != nil {
+			break
+		}
+		state, err := initialState(tasksToAdd[i])
+		if err != nil {
+			dependencyErr = fmt.Errorf("task %v: %v", i, err)
+			break
+		}
+		createTask(&tasksToAdd[i], state)
+	}
+	if limitErr == nil && dependencyErr == nil {
+		if err = storeTasks(tasksToAdd); err == nil {
+			for _, t := range tasksToAdd {
+				linkTask(t)
+			}
+		}
+	}
+	datastoreMutex.Unlock()
+
+	if limitErr != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Error: ", limitErr)
+		return
+	} else if dependencyErr != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: ", dependencyErr)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store new tasks", nlog.Data{"err": err, "tasks": len(tasksToAdd)})
+		return
+	}
+
+	response, err := json.Marshal(ids)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	log.Info("Created tasks", nlog.Data{"tasks": len(ids)})
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(response))
+}
+
+// Statuses answers with the state (and failure reason) of every task in the
+// JSON list of ids in the request body, in the same order. With "tenant" in
+// the query, tasks of other tenants are answered as if they didn't exist.
+func (h *Handler) Statuses(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	_, onlyTenant := values["tenant"]
+	tenant := values.Get("tenant")
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	ids := []task.ID{}
+	if err = json.Unmarshal(data, &ids); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(ids) == 0 || len(ids) > maxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: A batch holds between 1 and %v ids", maxBatchSize)
+		return
+	}
+
+	statuses := make([]taskStatus, len(ids))
+	datastoreMutex.RLock()
+	for i, id := range ids {
+		statuses[i].Id = id
+		if t, ok := datastore[id]; ok && (!onlyTenant || t.Tenant == tenant) {
+			state := t.State
+			statuses[i].State = &state
+			statuses[i].Error = t.Error
+			statuses[i].Tenant = t.Tenant
+		}
+	}
+	datastoreMutex.RUnlock()
+
+	response, err := json.Marshal(statuses)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(response))
+}
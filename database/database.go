@@ -1,12 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pmalek/image_service/task"
@@ -14,12 +16,8 @@ import (
 )
 
 var (
-	datastore      map[int]task.Task
+	datastore      map[task.ID]task.Task
 	datastoreMutex sync.RWMutex
-	oNFTMutex      sync.RWMutex
-
-	// remember to account for potential int overflow in production. Use something bigger.
-	oldestNotFinishedTask int
 
 	log *nlog.Logger
 )
@@ -38,13 +36,13 @@ func init() {
 }
 
 func registerInKVStore() bool {
-	if len(os.Args) < 3 {
+	if flag.NArg() < 2 {
 		fmt.Println("Error: Too few arguments.")
 		return false
 	}
 
-	databaseAddress := os.Args[1] // The address of itself
-	keyValueStoreAddress := os.Args[2]
+	databaseAddress := flag.Arg(0) // The address of itself
+	keyValueStoreAddress := flag.Arg(1)
 
 	response, err := http.Post("http://"+keyValueStoreAddress+"/set?key=databaseAddress&value="+databaseAddress, "", nil)
 	if err != nil {
@@ -64,25 +62,61 @@ func registerInKVStore() bool {
 }
 
 func init() {
-	datastore = make(map[int]task.Task)
+	datastore = make(map[task.ID]task.Task)
 	datastoreMutex = sync.RWMutex{}
-	oldestNotFinishedTask = 0
-	oNFTMutex = sync.RWMutex{}
 }
 
 func main() {
+	flag.DurationVar(&leaseTTL, "lease", 30*time.Second, "how long a worker may hold a task without renewing its lease")
+	leaseCheck := flag.Duration("lease-check", time.Second, "how often expired leases are looked for")
+	flag.IntVar(&maxAttempts, "max-attempts", 3, "how many times a task is tried before it fails for good")
+	flag.DurationVar(&agingStep, "aging", 10*time.Second, "how long a queued task waits to gain one priority level")
+	dir := flag.String("data", "data", "directory keeping the write-ahead log and snapshots")
+	snapshotInterval := flag.Duration("snapshot", 5*time.Minute, "how often the datastore is snapshotted and the log compacted")
+	flag.DurationVar(&retention, "retention", 0, "how long done tasks and their images are kept, 0 keeps them forever")
+	gcInterval := flag.Duration("gc", time.Hour, "how often tasks past -retention are purged")
+	flag.IntVar(&feedSize, "feed", 100000, "how many of the latest task events the change feed keeps")
+	flag.DurationVar(&idempotencyWindow, "idempotency", 24*time.Hour, "how long a task submitted with an idempotency key isn't created again")
+	flag.Parse()
+
+	if leaseTTL <= 0 || *leaseCheck <= 0 || maxAttempts < 1 || *snapshotInterval <= 0 || agingStep <= 0 || *gcInterval <= 0 || feedSize <= 0 || idempotencyWindow <= 0 {
+		fmt.Println("Error: -lease, -lease-check, -max-attempts, -snapshot, -aging, -gc, -feed and -idempotency must be positive.")
+		return
+	}
+	if retention < 0 {
+		fmt.Println("Error: -retention can't be negative.")
+		return
+	}
+
+	if err := openDatastore(*dir); err != nil {
+		log.Fatal("Couldn't recover datastore", nlog.Data{"err": err, "dir": *dir})
+	}
+
 	if !registerInKVStore() {
 		return
 	}
 
+	go expireLeases(*leaseCheck)
+	go snapshotPeriodically(*snapshotInterval)
+	if retention > 0 {
+		go collectGarbage(*gcInterval)
+	}
+
 	h := NewHandler()
 	r := mux.NewRouter()
 	r.HandleFunc("/getById", h.GetById).Methods(http.MethodGet)
 	r.HandleFunc("/newTask", h.NewTask).Methods(http.MethodPost)
+	r.HandleFunc("/newTasks", h.NewTasks).Methods(http.MethodPost)
+	r.HandleFunc("/imageStored", h.ImageStored).Methods(http.MethodPost)
+	r.HandleFunc("/statuses", h.Statuses).Methods(http.MethodPost)
 	r.HandleFunc("/getNewTask", h.GetNewTask).Methods(http.MethodPost)
 	r.HandleFunc("/finishTask", h.FinishTask).Methods(http.MethodPost)
+	r.HandleFunc("/renewLease", h.RenewLease).Methods(http.MethodPost)
+	r.HandleFunc("/failTask", h.FailTask).Methods(http.MethodPost)
 	r.HandleFunc("/setById", h.SetById).Methods(http.MethodPost)
+	r.HandleFunc("/setPriority", h.SetPriority).Methods(http.MethodPost)
 	r.HandleFunc("/list", h.List).Methods(http.MethodGet)
+	r.HandleFunc("/changes", h.Changes).Methods(http.MethodGet)
 
 	log.Infof("Starting database server at :3001...")
 	http.ListenAndServe(":3001", r)
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// Every state transition of a task, its creation included, is an event with
+// a sequence number, one more than the event before. Consumers follow the
+// change feed (/changes) from the last sequence number they saw instead of
+// polling single tasks. The sequence numbers are logged along with the
+// tasks, so they carry on across restarts. Only the latest events are kept;
+// they're rebuilt from the log on startup. A consumer that fell further
+// behind than that is told so and has to catch up with /list.
+
+type taskEvent struct {
+	Seq    int64      `json:"seq"`
+	Id     task.ID    `json:"id"`
+	Tenant string     `json:"tenant,omitempty"`
+	From   task.State `json:"from"`
+	To     task.State `json:"to"`
+	At     time.Time  `json:"at"`
+	Worker string     `json:"worker,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+const (
+	defaultFeedWait = 30 * time.Second
+	maxFeedWait     = 5 * time.Minute
+
+	// How often an idle event stream gets a comment, so that proxies don't
+	// drop it.
+	feedKeepAlive = 15 * time.Second
+)
+
+var (
+	// How many of the latest events are kept.
+	feedSize int
+
+	// events holds the latest events in order, without gaps. It's guarded by
+	// feedMutex, and so are lastEventSeq and feedChanged. lastEventSeq only
+	// changes with datastoreMutex held too, so holding either is enough to
+	// read it.
+	feedMutex    sync.Mutex
+	events       []taskEvent
+	lastEventSeq int64
+
+	// Closed (and replaced) whenever there are new events.
+	feedChanged = make(chan struct{})
+)
+
+// newTransitions returns the transitions t went through since it was old.
+// Both are the same task, old is empty if t is new.
+func newTransitions(old, t task.Task) []task.Transition {
+	if len(t.History) <= len(old.History) {
+		return nil
+	}
+	return t.History[len(old.History):]
+}
+
+// publishEvents adds the events for the transitions of t to the feed, the
+// last of them numbered last. It must be called with datastoreMutex held.
+func publishEvents(t task.Task, transitions []task.Transition, last int64) {
+	if len(transitions) == 0 {
+		return
+	}
+
+	feedMutex.Lock()
+	defer feedMutex.Unlock()
+
+	seq := last - int64(len(transitions))
+	for _, transition := range transitions {
+		seq++
+		events = append(events, taskEvent{
+			Seq:    seq,
+			Id:     t.Id,
+			Tenant: t.Tenant,
+			From:   transition.From,
+			To:     transition.To,
+			At:     transition.At,
+			Worker: transition.Worker,
+			Reason: transition.Reason,
+		})
+	}
+	lastEventSeq = last
+
+	// Trimmed in one go once it's grown to twice its size, rather than on
+	// every event.
+	if len(events) >= 2*feedSize {
+		events = append([]taskEvent(nil), events[len(events)-feedSize:]...)
+	}
+
+	close(feedChanged)
+	feedChanged = make(chan struct{})
+}
+
+type feedPage struct {
+	Events []taskEvent `json:"events"`
+
+	// Pass as "since" to get the following events.
+	Next int64 `json:"next"`
+
+	// Closed when there are events after Next.
+	changed <-chan struct{}
+}
+
+// errFeedGone means some of the events asked for were dropped already.
+var errFeedGone = fmt.Errorf("events were dropped, resync with /list")
+
+// readFeed returns up to limit events after since, of the given tenant's
+// tasks only if tenant isn't empty.
+func readFeed(since int64, limit int, tenant string) (feedPage, error) {
+	feedMutex.Lock()
+	defer feedMutex.Unlock()
+
+	page := feedPage{Events: []taskEvent{}, Next: lastEventSeq, changed: feedChanged}
+	if since > lastEventSeq {
+		return page, fmt.Errorf("unknown sequence number %v, the last one is %v", since, lastEventSeq)
+	}
+	if since == lastEventSeq {
+		return page, nil
+	}
+	if len(events) == 0 || since+1 < events[0].Seq {
+		return page, errFeedGone
+	}
+
+	for _, event := range events[since+1-events[0].Seq:] {
+		if len(tenant) != 0 && event.Tenant != tenant {
+			continue
+		}
+		page.Events = append(page.Events, event)
+		if len(page.Events) == limit {
+			page.Next = event.Seq
+			break
+		}
+	}
+	return page, nil
+}
+
+// Changes is the change feed. It answers with the events after the
+// sequence number "since" as JSON, waiting for some for up to "wait" if
+// there are none yet. Without "since" it answers with no events and the
+// sequence number to follow the feed from. The query may also hold "limit"
+// and "tenant", to only see that tenant's tasks.
+//
+// With "Accept: text/event-stream" the events are streamed as Server-Sent
+// Events instead, starting after "since" or the Last-Event-ID header.
+//
+// Events that were dropped already are answered with 410 Gone.
+func (h *Handler) Changes(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	}
+
+	sinceStr := values.Get("since")
+	if lastEventId := r.Header.Get("Last-Event-ID"); len(lastEventId) != 0 {
+		sinceStr = lastEventId
+	}
+	var since int64
+	if len(sinceStr) != 0 {
+		if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil || since < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Error: Wrong since")
+			return
+		}
+	} else {
+		feedMutex.Lock()
+		since = lastEventSeq
+		feedMutex.Unlock()
+	}
+
+	limit := defaultListLimit
+	if limitStr := values.Get("limit"); len(limitStr) != 0 {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > maxListLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: limit must be between 1 and %v", maxListLimit)
+			return
+		}
+	}
+
+	wait := defaultFeedWait
+	if waitStr := values.Get("wait"); len(waitStr) != 0 {
+		if wait, err = time.ParseDuration(waitStr); err != nil || wait < 0 || wait > maxFeedWait {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error: wait must be a duration up to %v", maxFeedWait)
+			return
+		}
+	}
+
+	tenant := values.Get("tenant")
+
+	page, err := readFeed(since, limit, tenant)
+	if err == errFeedGone {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	}
+
+	if r.Header.Get("Accept") == "text/event-stream" {
+		streamFeed(w, r, page, limit, tenant)
+		return
+	}
+
+	if len(page.Events) == 0 && len(sinceStr) != 0 && wait > 0 {
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+	waiting:
+		for len(page.Events) == 0 {
+			select {
+			case <-page.changed:
+			case <-timeout.C:
+				break waiting
+			case <-r.Context().Done():
+				return
+			}
+			if page, err = readFeed(page.Next, limit, tenant); err != nil {
+				// Can only be errFeedGone, if a burst of events went by.
+				w.WriteHeader(http.StatusGone)
+				fmt.Fprint(w, "Error: ", err)
+				return
+			}
+		}
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// streamFeed sends the events of page, and all the following ones, as
+// Server-Sent Events until the client goes away or falls too far behind.
+func streamFeed(w http.ResponseWriter, r *http.Request, page feedPage, limit int, tenant string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		for _, event := range page.Events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %v\ndata: %s\n\n", event.Seq, data)
+		}
+		flusher.Flush()
+
+		// Events of other tenants are skipped without waiting.
+		if len(page.Events) != limit {
+			select {
+			case <-page.changed:
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		var err error
+		if page, err = readFeed(page.Next, limit, tenant); err != nil {
+			fmt.Fprintf(w, "event: gone\ndata: %v\n\n", err)
+			flusher.Flush()
+			return
+		}
+	}
+}
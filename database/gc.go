@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// Tasks done for longer than the retention period are purged: first the
+// task is removed from the datastore, leaving a tombstone, then storage is
+// asked to delete its images and only once it has the tombstone goes too.
+// Both steps are logged, so a task never points at a deleted image and
+// images of purged tasks are deleted even if storage or the database were
+// down in between.
+
+var (
+	// How long finished, failed and cancelled tasks are kept. Zero keeps
+	// them forever.
+	retention time.Duration
+
+	// Ids of the purged tasks whose images may still be in storage, guarded
+	// by datastoreMutex.
+	tombstones = make(map[task.ID]bool)
+
+	// Only used by the collector.
+	storageLocation string
+)
+
+func collectGarbage(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		purgeTasks(now.Add(-retention))
+		deletePurgedImages()
+	}
+}
+
+// purgeTasks purges the tasks done before the given time. Tasks still
+// needed as input by a task depending on them are kept.
+func purgeTasks(before time.Time) {
+	// Finding candidates doesn't keep writers waiting.
+	candidates := []task.ID{}
+	datastoreMutex.RLock()
+	for id, t := range datastore {
+		if purgeable(t, before) {
+			candidates = append(candidates, id)
+		}
+	}
+	datastoreMutex.RUnlock()
+
+	purged := 0
+	datastoreMutex.Lock()
+	for _, id := range candidates {
+		if t, ok := datastore[id]; ok && purgeable(t, before) {
+			if err := purgeTask(t); err != nil {
+				log.Error("Couldn't purge task", nlog.Data{"err": err, "id": id})
+				break
+			}
+			purged++
+		}
+	}
+	if purged != 0 {
+		unindexPurgedTasks()
+	}
+	datastoreMutex.Unlock()
+
+	if purged != 0 {
+		log.Info("Purged old tasks", nlog.Data{"purged": purged, "before": before})
+	}
+}
+
+// purgeable must be called with datastoreMutex held.
+func purgeable(t task.Task, before time.Time) bool {
+	if !t.State.Terminal() || t.FinishedAt == nil || !t.FinishedAt.Before(before) {
+		return false
+	}
+	for _, id := range children[t.Id] {
+		if !datastore[id].State.Terminal() {
+			return false
+		}
+	}
+	return true
+}
+
+// purgeTask must be called with datastoreMutex held.
+func purgeTask(t task.Task) error {
+	if err := appendRecords(walRecord{Op: opPurge, Task: task.Task{Id: t.Id}}); err != nil {
+		return err
+	}
+
+	delete(datastore, t.Id)
+	tombstones[t.Id] = true
+	forgetIdempotencyKey(t)
+	releaseLease(t.Id)
+	for _, parent := range t.DependsOn {
+		siblings := children[parent]
+		for i, id := range siblings {
+			if id == t.Id {
+				children[parent] = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(children, t.Id)
+	return nil
+}
+
+// deletePurgedImages asks storage to delete the images of every tombstoned
+// task. What fails is tried again on the next run.
+func deletePurgedImages() {
+	datastoreMutex.RLock()
+	ids := make([]task.ID, 0, len(tombstones))
+	for id := range tombstones {
+		ids = append(ids, id)
+	}
+	datastoreMutex.RUnlock()
+
+	for _, id := range ids {
+		if err := deleteImages(id); err != nil {
+			log.Error("Couldn't delete images of purged task", nlog.Data{"err": err, "id": id})
+			return
+		}
+
+		datastoreMutex.Lock()
+		err := appendRecords(walRecord{Op: opForget, Task: task.Task{Id: id}})
+		if err == nil {
+			delete(tombstones, id)
+		}
+		datastoreMutex.Unlock()
+		if err != nil {
+			log.Error("Couldn't forget purged task", nlog.Data{"err": err, "id": id})
+			return
+		}
+	}
+}
+
+func deleteImages(id task.ID) error {
+	if len(storageLocation) == 0 {
+		location, err := getStorageAddress()
+		if err != nil {
+			return err
+		}
+		storageLocation = location
+	}
+
+	response, err := http.Post("http://"+storageLocation+"/deleteImages?id="+string(id), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage returned HTTP status %v: %s", response.StatusCode, data)
+	}
+	return nil
+}
+
+func getStorageAddress() (string, error) {
+	keyValueStoreAddress := flag.Arg(1)
+
+	response, err := http.Get("http://" + keyValueStoreAddress + "/get?key=storageAddress")
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK || len(data) == 0 {
+		return "", fmt.Errorf("can't get storage address, key value store returned HTTP status %v: %s", response.StatusCode, data)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// Tasks may depend on others (see task.Task.DependsOn). A task can only
+// depend on tasks that already exist, so the dependencies never form a
+// cycle. A task waits until all of its parents are finished and then goes
+// to the queue; if one of them fails or is cancelled instead, the task and
+// everything depending on it fails.
+
+// children maps a task id to the ids of the tasks depending on it, guarded
+// by datastoreMutex.
+var children = make(map[task.ID][]task.ID)
+
+// initialState returns the state the new task t starts in: waiting if any
+// of its parents isn't done yet, queued otherwise. It must be called with
+// datastoreMutex held.
+func initialState(t task.Task) (task.State, error) {
+	state := task.Queued
+	for _, id := range t.DependsOn {
+		parent, ok := datastore[id]
+		if !ok {
+			return state, fmt.Errorf("unknown parent task %v", id)
+		}
+		switch parent.State {
+		case task.Finished:
+		case task.Failed, task.Cancelled:
+			return state, fmt.Errorf("parent task %v is %v", id, parent.State)
+		default:
+			state = task.Waiting
+		}
+	}
+	return state, nil
+}
+
+// linkTask records the dependencies of t. It must be called with
+// datastoreMutex held.
+func linkTask(t task.Task) {
+	for _, id := range t.DependsOn {
+		children[id] = append(children[id], t.Id)
+	}
+}
+
+// parentsFinished must be called with datastoreMutex held.
+func parentsFinished(t task.Task) bool {
+	for _, id := range t.DependsOn {
+		if datastore[id].State != task.Finished {
+			return false
+		}
+	}
+	return true
+}
+
+// settleChildren moves the tasks waiting for parent along once parent is
+// done. It must be called with datastoreMutex held, after parent was stored.
+func settleChildren(parent task.Task) {
+	if !parent.State.Terminal() {
+		return
+	}
+
+	for _, id := range children[parent.Id] {
+		child := datastore[id]
+		if child.State != task.Waiting {
+			continue
+		}
+
+		var err error
+		if parent.State == task.Finished {
+			if !parentsFinished(child) {
+				continue
+			}
+			err = moveTask(&child, task.Queued, "", "parents finished")
+		} else {
+			child.Error = fmt.Sprintf("parent task %v %v", parent.Id, parent.State)
+			err = moveTask(&child, task.Failed, "", child.Error)
+		}
+		if err == nil {
+			// Fails the child's own children in turn, if need be.
+			err = storeTask(child)
+		}
+		if err != nil {
+			// Retried when the datastore is recovered next time.
+			log.Error("Couldn't settle dependent task", nlog.Data{"err": err, "id": id, "parent": parent.Id})
+		}
+	}
+}
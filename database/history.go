@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// createTask stamps a new task starting in state and starts its history.
+func createTask(t *task.Task, state task.State) {
+	now := time.Now()
+	t.State = state
+	t.CreatedAt = &now
+	t.History = []task.Transition{{From: state, To: state, At: now, Reason: "created"}}
+}
+
+// moveTask changes the state of t, keeping its timestamps and history up to
+// date. worker is the worker causing the change, if any, and reason says
+// why. Every state change in the database goes through here.
+func moveTask(t *task.Task, to task.State, worker, reason string) error {
+	from := t.State
+	if err := t.SetState(to); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case to == task.Leased:
+		t.LeasedAt = &now
+		t.Worker = worker
+	case to.Terminal():
+		t.FinishedAt = &now
+	}
+
+	t.History = append(t.History, task.Transition{From: from, To: to, At: now, Worker: worker, Reason: reason})
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// A task submitted with an idempotency key (see task.Task.IdempotencyKey)
+// that was already used for a task of the same tenant within the
+// idempotency window isn't created again; the original task's id is
+// answered instead. That's only if the spec is the same as the first time
+// and the first submission got as far as storing the image (see
+// ImageStored); a spec that differs is refused. The keys are logged along
+// with their tasks.
+
+// idempotencyWindow is how long a key is remembered after its task was
+// created.
+var idempotencyWindow time.Duration
+
+// idempotencyKeys maps a tenant and key to the latest task created with
+// them, guarded by datastoreMutex.
+var idempotencyKeys = make(map[string]task.ID)
+
+func idempotencyKeyOf(t task.Task) string {
+	return t.Tenant + "\x00" + t.IdempotencyKey
+}
+
+// rememberIdempotencyKey must be called with datastoreMutex held.
+func rememberIdempotencyKey(t task.Task) {
+	if len(t.IdempotencyKey) == 0 {
+		return
+	}
+
+	key := idempotencyKeyOf(t)
+	if id, ok := idempotencyKeys[key]; ok {
+		if other, ok := datastore[id]; ok && createdAfter(other, t) {
+			return
+		}
+	}
+	idempotencyKeys[key] = t.Id
+}
+
+// forgetIdempotencyKey must be called with datastoreMutex held.
+func forgetIdempotencyKey(t task.Task) {
+	if len(t.IdempotencyKey) != 0 && idempotencyKeys[idempotencyKeyOf(t)] == t.Id {
+		delete(idempotencyKeys, idempotencyKeyOf(t))
+	}
+}
+
+var errKeyReused = errors.New("the idempotency key was used for a different task")
+
+// specHash identifies the spec t was submitted with. NotBefore is left out,
+// as master works it out from a delay relative to the time of submission.
+func specHash(t task.Task) string {
+	spec := t.Spec()
+	spec.NotBefore = nil
+	data, _ := json.Marshal(spec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// submittedTask returns the task submitted before with the key of spec, if
+// it's still within the window. Cancelled tasks don't count: master cancels
+// a task whose upload failed, and the retry of that upload has to create a
+// new one. Neither do tasks whose upload never finished. It fails with
+// errKeyReused if the task was submitted with another spec. It must be
+// called with datastoreMutex held.
+func submittedTask(spec task.Task, now time.Time) (task.Task, bool, error) {
+	if len(spec.IdempotencyKey) == 0 {
+		return task.Task{}, false, nil
+	}
+
+	id, ok := idempotencyKeys[idempotencyKeyOf(spec)]
+	if !ok {
+		return task.Task{}, false, nil
+	}
+	t, ok := datastore[id]
+	if !ok || t.State == task.Cancelled || t.CreatedAt == nil || now.Sub(*t.CreatedAt) > idempotencyWindow {
+		return task.Task{}, false, nil
+	}
+	if len(t.SpecHash) != 0 && t.SpecHash != specHash(spec) {
+		return task.Task{}, false, errKeyReused
+	}
+	if !t.ImageStored && len(t.DependsOn) == 0 {
+		return task.Task{}, false, nil
+	}
+	return t, true, nil
+}
+
+// ImageStored records that the image of the task "id" was uploaded, which
+// master tells for tasks with an idempotency key.
+func (h *Handler) ImageStored(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	id, err := task.ParseID(values.Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	bErrored := false
+
+	datastoreMutex.Lock()
+	if taskToSet, ok := datastore[id]; !ok {
+		bErrored = true
+	} else if !taskToSet.ImageStored {
+		taskToSet.ImageStored = true
+		err = storeTask(taskToSet)
+	}
+	datastoreMutex.Unlock()
+
+	if bErrored {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: No such task")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store task", nlog.Data{"err": err, "id": id})
+		return
+	}
+
+	fmt.Fprint(w, "success")
+}
+
+func createdAfter(a, b task.Task) bool {
+	if a.CreatedAt == nil || b.CreatedAt == nil {
+		return a.CreatedAt != nil
+	}
+	return a.CreatedAt.After(*b.CreatedAt)
+}
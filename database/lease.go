@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+var (
+	// How long a worker may hold a task without renewing its lease.
+	leaseTTL time.Duration
+
+	// After this many attempts a task isn't retried any more but failed.
+	maxAttempts int
+
+	// Lease deadlines of the leased tasks, guarded by datastoreMutex.
+	leases map[task.ID]time.Time
+
+	// The last fencing token handed out, guarded by datastoreMutex.
+	lastLeaseToken int64
+)
+
+func init() {
+	leases = make(map[task.ID]time.Time)
+}
+
+// grantLease starts a new lease on the task and returns its fencing token.
+// It must be called with datastoreMutex held.
+func grantLease(id task.ID) int64 {
+	lastLeaseToken++
+	leases[id] = time.Now().Add(leaseTTL)
+	return lastLeaseToken
+}
+
+// extendLease must be called with datastoreMutex held.
+func extendLease(id task.ID) {
+	leases[id] = time.Now().Add(leaseTTL)
+}
+
+// holdsLease reports whether token belongs to the current, unexpired lease on
+// the task. It must be called with datastoreMutex held.
+func holdsLease(id task.ID, token int64) bool {
+	_, leased := leases[id]
+	current, ok := datastore[id]
+	return leased && ok && current.State == task.Leased && current.LeaseToken == token
+}
+
+// releaseLease must be called with datastoreMutex held.
+func releaseLease(id task.ID) {
+	delete(leases, id)
+}
+
+// retryOrFail ends the current attempt at the leased task t with reason.
+// The task goes back to the queue unless it ran out of attempts, in which
+// case it fails for good.
+func retryOrFail(t task.Task, reason string) (task.Task, error) {
+	t.Error = reason
+	if t.Attempts >= maxAttempts {
+		return t, moveTask(&t, task.Failed, t.Worker, reason)
+	}
+	return t, moveTask(&t, task.Queued, t.Worker, reason)
+}
+
+// expireLeases ends the attempt of every task whose lease ran out, putting
+// it back in the queue or failing it. It's the only place leases expire,
+// checked once every interval.
+func expireLeases(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		datastoreMutex.Lock()
+		for id, deadline := range leases {
+			if now.Before(deadline) {
+				continue
+			}
+
+			expired, err := retryOrFail(datastore[id], "lease expired")
+			if err == nil {
+				err = storeTask(expired)
+			}
+			if err != nil {
+				// Tried again on the next tick.
+				log.Error("Couldn't expire lease", nlog.Data{"id": id, "err": err})
+				continue
+			}
+			releaseLease(id)
+			log.Info("Lease expired", nlog.Data{"id": id, "state": expired.State})
+		}
+		datastoreMutex.Unlock()
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	// How many tasks List looks at before letting writers have the lock.
+	listBatch = 1000
+)
+
+// Every task id in order (see task.ID.Less), guarded by datastoreMutex. List
+// pages through it.
+var taskIds []task.ID
+
+// indexTask adds the id of a new task to taskIds. New ids are nearly always
+// the biggest so far, making this an append. It must be called with
+// datastoreMutex held.
+func indexTask(id task.ID) {
+	i := sort.Search(len(taskIds), func(i int) bool { return !taskIds[i].Less(id) })
+	taskIds = append(taskIds, "")
+	copy(taskIds[i+1:], taskIds[i:])
+	taskIds[i] = id
+}
+
+// reindexTasks rebuilds taskIds from the datastore. It must be called with
+// datastoreMutex held.
+func reindexTasks() {
+	taskIds = make([]task.ID, 0, len(datastore))
+	for id := range datastore {
+		taskIds = append(taskIds, id)
+	}
+	sort.Slice(taskIds, func(i, j int) bool { return taskIds[i].Less(taskIds[j]) })
+}
+
+// unindexPurgedTasks drops the ids of purged tasks from taskIds. It must be
+// called with datastoreMutex held.
+func unindexPurgedTasks() {
+	kept := taskIds[:0]
+	for _, id := range taskIds {
+		if _, ok := datastore[id]; ok {
+			kept = append(kept, id)
+		}
+	}
+	for i := len(kept); i < len(taskIds); i++ {
+		taskIds[i] = ""
+	}
+	taskIds = kept
+}
+
+// listFilter selects the tasks returned by List.
+type listFilter struct {
+	states        map[task.State]bool // any state if empty
+	minId, maxId  task.ID             // inclusive, either may be empty
+	createdAfter  time.Time
+	createdBefore time.Time
+	tenant        string
+}
+
+type listPage struct {
+	Tasks []task.Task `json:"tasks"`
+
+	// Pass as "cursor" to get the next page. Empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// List answers with the tasks matching the query as JSON, ordered by id (and
+// so by creation time, to the millisecond). Legacy decimal ids come first,
+// in numeric order, and may be used in id ranges too. The query may hold:
+//
+//	state          comma separated state names
+//	minId, maxId   inclusive id range
+//	createdAfter   RFC 3339 time, exclusive
+//	createdBefore  RFC 3339 time, exclusive
+//	tenant         the tenant the tasks belong to
+//	limit          page size, at most 1000 (default 100)
+//	cursor         "next" of the previous page
+//
+// The lock is taken for a batch of tasks at a time, so even a sparse filter
+// over a large datastore doesn't hold up other requests. Tasks changing
+// while a page is being put together may show in their old or new state.
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	filter, limit, from, err := parseListQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	}
+
+	page := listPage{Tasks: []task.Task{}}
+	for done := false; !done; {
+		datastoreMutex.RLock()
+		// Ids may have come and gone since the last batch, look for where
+		// it stopped again.
+		i := sort.Search(len(taskIds), func(i int) bool { return from.after(taskIds[i]) })
+		end := len(taskIds)
+		if len(filter.maxId) != 0 {
+			end = sort.Search(len(taskIds), func(i int) bool { return filter.maxId.Less(taskIds[i]) })
+		}
+
+		for batchEnd := i + listBatch; i < end && i < batchEnd && len(page.Tasks) < limit; i++ {
+			if t := datastore[taskIds[i]]; filter.matches(t) {
+				page.Tasks = append(page.Tasks, t)
+			}
+			from = listPosition{id: taskIds[i], exclusive: true}
+		}
+
+		done = i >= end || len(page.Tasks) == limit
+		if len(page.Tasks) == limit && i < end {
+			page.Next = string(from.id)
+		}
+		datastoreMutex.RUnlock()
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(response))
+}
+
+// listPosition is where a page starts: at id, or right after it.
+type listPosition struct {
+	id        task.ID
+	exclusive bool
+}
+
+// after reports whether id comes at or after the position.
+func (p listPosition) after(id task.ID) bool {
+	if p.exclusive {
+		return p.id.Less(id)
+	}
+	return !id.Less(p.id)
+}
+
+// parseListQuery returns the filter, the page size and where to start.
+func parseListQuery(values url.Values) (listFilter, int, listPosition, error) {
+	filter := listFilter{tenant: values.Get("tenant")}
+	limit := defaultListLimit
+	from := listPosition{}
+	var err error
+
+	if states := values.Get("state"); len(states) != 0 {
+		filter.states = make(map[task.State]bool)
+		for _, name := range strings.Split(states, ",") {
+			state, err := task.ParseState(strings.TrimSpace(name))
+			if err != nil {
+				return filter, 0, from, err
+			}
+			filter.states[state] = true
+		}
+	}
+
+	for key, dst := range map[string]*task.ID{"minId": &filter.minId, "maxId": &filter.maxId} {
+		if value := values.Get(key); len(value) != 0 {
+			if *dst, err = task.ParseID(value); err != nil {
+				return filter, 0, from, err
+			}
+		}
+	}
+
+	if value := values.Get("limit"); len(value) != 0 {
+		if limit, err = strconv.Atoi(value); err != nil {
+			return filter, 0, from, fmt.Errorf("wrong limit %q", value)
+		}
+	}
+	if limit < 1 || limit > maxListLimit {
+		return filter, 0, from, fmt.Errorf("limit out of range [1, %v]", maxListLimit)
+	}
+
+	for key, dst := range map[string]*time.Time{"createdAfter": &filter.createdAfter, "createdBefore": &filter.createdBefore} {
+		if value := values.Get(key); len(value) != 0 {
+			if *dst, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, 0, from, fmt.Errorf("wrong %v %q, expected an RFC 3339 time", key, value)
+			}
+		}
+	}
+
+	from.id = filter.minId
+	if cursor := values.Get("cursor"); len(cursor) != 0 {
+		last, err := task.ParseID(cursor)
+		if err != nil {
+			return filter, 0, from, fmt.Errorf("wrong cursor %q", cursor)
+		}
+		if !last.Less(from.id) {
+			from = listPosition{id: last, exclusive: true}
+		}
+	}
+
+	return filter, limit, from, nil
+}
+
+func (f listFilter) matches(t task.Task) bool {
+	if len(f.states) != 0 && !f.states[t.State] {
+		return false
+	}
+	if len(f.tenant) != 0 && t.Tenant != f.tenant {
+		return false
+	}
+	if !f.createdAfter.IsZero() && (t.CreatedAt == nil || !t.CreatedAt.After(f.createdAfter)) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && (t.CreatedAt == nil || !t.CreatedAt.Before(f.createdBefore)) {
+		return false
+	}
+	return true
+}
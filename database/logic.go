@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
 )
 
 type Handler struct{}
@@ -30,7 +32,7 @@ func (h *Handler) GetById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := strconv.Atoi(string(values.Get("id")))
+	id, err := task.ParseID(values.Get("id"))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, err)
@@ -38,19 +40,16 @@ func (h *Handler) GetById(w http.ResponseWriter, r *http.Request) {
 	}
 
 	datastoreMutex.RLock()
-	bIsInError := err != nil || id >= len(datastore) // Reading the length of a slice must be done in a synchronized manner. That's why the mutex is used.
+	value, ok := datastore[id]
 	datastoreMutex.RUnlock()
 
-	if bIsInError {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Wrong input")
+	if !ok {
+		// Never created, or purged.
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: No such task")
 		return
 	}
 
-	datastoreMutex.RLock()
-	value := datastore[id]
-	datastoreMutex.RUnlock()
-
 	response, err := json.Marshal(value)
 
 	if err != nil {
@@ -62,70 +61,140 @@ func (h *Handler) GetById(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(response))
 }
 
+// NewTask creates a task from the spec in the request body and answers with
+// its id. A spec carrying an idempotency key that was used already is
+// answered with the id of the task created then, and the header
+// Idempotent-Replayed, or with 409 if that task had a different spec. The query may cap the unfinished tasks of the task's
+// tenant with "maxTasks"; going over it is answered with 429.
 func (h *Handler) NewTask(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	maxTasks, err := maxTasksFromQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	spec := task.Task{}
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &spec)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+	}
+	taskToAdd := spec.Spec()
+	if err = taskToAdd.ValidateSpec(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	taskToAdd.Id = task.NewID()
+	if len(taskToAdd.IdempotencyKey) != 0 {
+		taskToAdd.SpecHash = specHash(taskToAdd)
+	}
+
+	var dependencyErr, limitErr error
 	datastoreMutex.Lock()
-	taskToAdd := task.Task{
-		Id:    len(datastore),
-		State: 0,
+	submitted, repeated, keyErr := submittedTask(taskToAdd, time.Now())
+	if !repeated && keyErr == nil {
+		limitErr = checkTaskLimit(map[string]int{taskToAdd.Tenant: 1}, maxTasks)
+	}
+	if !repeated && keyErr == nil && limitErr == nil {
+		var state task.State
+		if state, dependencyErr = initialState(taskToAdd); dependencyErr == nil {
+			createTask(&taskToAdd, state)
+			if err = storeTask(taskToAdd); err == nil {
+				linkTask(taskToAdd)
+				rememberIdempotencyKey(taskToAdd)
+			}
+		}
 	}
-	datastore[taskToAdd.Id] = taskToAdd
 	datastoreMutex.Unlock()
 
+	if repeated {
+		log.Info("Task submitted again", nlog.Data{"id": submitted.Id, "idempotencyKey": submitted.IdempotencyKey})
+		w.Header().Set("Idempotent-Replayed", "true")
+		fmt.Fprint(w, submitted.Id)
+		return
+	}
+
+	if keyErr != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: ", keyErr)
+		return
+	} else if limitErr != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Error: ", limitErr)
+		return
+	} else if dependencyErr != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: ", dependencyErr)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store new task", nlog.Data{"err": err})
+		return
+	}
+
 	fmt.Fprint(w, taskToAdd.Id)
 }
 
 func (h *Handler) GetNewTask(w http.ResponseWriter, r *http.Request) {
-	noTasks := false
-
-	datastoreMutex.RLock()
-	if len(datastore) == 0 {
-		noTasks = true
-	}
-	datastoreMutex.RUnlock()
-
-	if noTasks {
-		w.WriteHeader(http.StatusNoContent)
-		fmt.Fprint(w, "Info: No non-started task.")
-		log.Infof("No non-started task.")
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
 		return
 	}
+	worker := values.Get("worker") // identifies the worker in the task's history
 
-	taskToSend := task.Task{Id: -1, State: 0}
+	taskToSend := task.Task{}
 
-	oNFTMutex.Lock()
 	datastoreMutex.Lock()
-	for i := oldestNotFinishedTask; i < len(datastore); i++ {
-		if datastore[i].State == 2 && i == oldestNotFinishedTask {
-			oldestNotFinishedTask++
-			continue
-		}
-		if datastore[i].State == 0 {
-			datastore[i] = task.Task{Id: i, State: 1}
-			taskToSend = datastore[i]
-			break
+	promoteDueTasks(time.Now())
+	if id, ok := pending.next(); ok {
+		taskToSend = datastore[id]
+		moveTask(&taskToSend, task.Leased, worker, "")
+		taskToSend.Attempts++
+		taskToSend.LeaseToken = grantLease(id)
+		if err = storeTask(taskToSend); err != nil {
+			releaseLease(id)
+			taskToSend = task.Task{}
 		}
 	}
 	datastoreMutex.Unlock()
-	oNFTMutex.Unlock()
 
-	if taskToSend.Id == -1 {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store leased task", nlog.Data{"err": err})
+		return
+	}
+
+	if len(taskToSend.Id) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		fmt.Fprint(w, "Info: No non-started task.")
 		log.Infof("No non-started task.")
 		return
 	}
 
-	myId := taskToSend.Id
-
-	go func() {
-		time.Sleep(time.Second * 120)
-		datastoreMutex.Lock()
-		if datastore[myId].State == 1 {
-			datastore[myId] = task.Task{Id: myId, State: 0}
-		}
-		datastoreMutex.Unlock()
-	}()
-
+	taskToSend.LeaseTTL = leaseTTL
 	response, err := json.Marshal(taskToSend)
 
 	if err != nil {
@@ -149,7 +218,7 @@ func (h *Handler) FinishTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := strconv.Atoi(string(values.Get("id")))
+	id, err := task.ParseID(values.Get("id"))
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -157,27 +226,164 @@ func (h *Handler) FinishTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	updatedTask := task.Task{Id: id, State: 2}
+	token, err := strconv.ParseInt(values.Get("token"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Wrong lease token")
+		return
+	}
 
 	bErrored := false
 
 	datastoreMutex.Lock()
-	if datastore[id].State == 1 {
-		datastore[id] = updatedTask
+	if updatedTask, ok := datastore[id]; ok && holdsLease(id, token) {
+		moveTask(&updatedTask, task.Finished, updatedTask.Worker, "")
+		updatedTask.Error = ""
+		if err = storeTask(updatedTask); err == nil {
+			releaseLease(id)
+		}
 	} else {
 		bErrored = true
 	}
 	datastoreMutex.Unlock()
 
 	if bErrored {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: Task is not leased with this token")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store finished task", nlog.Data{"err": err, "id": id})
+		return
+	}
+
+	fmt.Fprint(w, "success")
+}
+
+// RenewLease extends the lease with the given token by another lease TTL.
+// Workers call it periodically while they process the task; once the lease
+// has expired or the task was leased again it can't be renewed any more.
+func (h *Handler) RenewLease(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Error: Wrong input")
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	id, err := task.ParseID(values.Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	token, err := strconv.ParseInt(values.Get("token"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Wrong lease token")
+		return
+	}
+
+	bLeased := false
+	datastoreMutex.Lock()
+	if holdsLease(id, token) {
+		extendLease(id)
+		bLeased = true
+	}
+	datastoreMutex.Unlock()
+
+	if !bLeased {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: Task is not leased")
 		return
 	}
 
 	fmt.Fprint(w, "success")
 }
 
+// The longest failure reason kept for a task.
+const maxErrorLength = 1024
+
+// FailTask ends the current attempt at a task with the error message in the
+// request body. The task is retried unless it ran out of attempts, in which
+// case it moves to the failed state.
+func (h *Handler) FailTask(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	id, err := task.ParseID(values.Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	token, err := strconv.ParseInt(values.Get("token"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Wrong lease token")
+		return
+	}
+
+	reason, err := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorLength))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(reason) == 0 {
+		reason = []byte("unknown error")
+	}
+
+	bErrored := false
+	failedTask := task.Task{}
+
+	datastoreMutex.Lock()
+	if holdsLease(id, token) {
+		failedTask, err = retryOrFail(datastore[id], string(reason))
+		if err == nil {
+			if err = storeTask(failedTask); err == nil {
+				releaseLease(id)
+			}
+		}
+	} else {
+		bErrored = true
+	}
+	datastoreMutex.Unlock()
+
+	if bErrored {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: Task is not leased with this token")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store failed task", nlog.Data{"err": err, "id": id})
+		return
+	}
+
+	log.Info("Task attempt failed", nlog.Data{"id": id, "attempts": failedTask.Attempts, "state": failedTask.State, "reason": failedTask.Error})
+	fmt.Fprint(w, "success")
+}
+
+// SetById overwrites the spec (and possibly the state) of a task with the
+// one in the request body. The body must hold the version of the task it's
+// based on; if the task was stored since, nothing is changed and 409
+// Conflict is answered.
 func (h *Handler) SetById(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -193,13 +399,67 @@ func (h *Handler) SetById(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err)
 		return
 	}
+	if err = taskToSet.ValidateSpec(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if taskToSet.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: The version of the task, as got from /getById, is required")
+		return
+	}
 
 	bErrored := false
+	var transitionErr, storeErr error
+
 	datastoreMutex.Lock()
-	if taskToSet.Id >= len(datastore) || taskToSet.State > 2 || taskToSet.State < 0 {
+	current, ok := datastore[taskToSet.Id]
+	if !ok {
 		bErrored = true
+	} else if taskToSet.Version != current.Version {
+		transitionErr = fmt.Errorf("task %v changed since version %v, it's at version %v now", current.Id, taskToSet.Version, current.Version)
+	} else if taskToSet.State != current.State && !current.State.CanTransitionTo(taskToSet.State) {
+		transitionErr = fmt.Errorf("task %v can't go from %v to %v", current.Id, current.State, taskToSet.State)
+	} else if taskToSet.State == task.Queued && current.State != task.Queued && !parentsFinished(current) {
+		transitionErr = fmt.Errorf("task %v still waits for its parents", current.Id)
 	} else {
-		datastore[taskToSet.Id] = taskToSet
+		// Lifecycle fields are the database's to keep, whatever was sent.
+		state := taskToSet.State
+		taskToSet.State = current.State
+		taskToSet.LeaseToken = current.LeaseToken
+		taskToSet.CreatedAt = current.CreatedAt
+		taskToSet.LeasedAt = current.LeasedAt
+		taskToSet.FinishedAt = current.FinishedAt
+		taskToSet.Worker = current.Worker
+		taskToSet.History = current.History
+		taskToSet.DependsOn = current.DependsOn
+		taskToSet.IdempotencyKey = current.IdempotencyKey
+		taskToSet.SpecHash = current.SpecHash
+		taskToSet.ImageStored = current.ImageStored
+		taskToSet.LeaseTTL = current.LeaseTTL
+		taskToSet.Attempts = current.Attempts
+		if state != current.State {
+			moveTask(&taskToSet, state, "", "set by admin")
+		}
+		// A task put back in the queue by hand gets all of its attempts
+		// again, or one that failed for good would fail on its next try.
+		if state == task.Queued && current.State != task.Queued {
+			taskToSet.Attempts = 0
+		}
+
+		newLease := state == task.Leased && current.State != task.Leased
+		if newLease {
+			taskToSet.LeaseToken = grantLease(taskToSet.Id)
+		}
+
+		if storeErr = storeTask(taskToSet); storeErr != nil {
+			if newLease {
+				releaseLease(taskToSet.Id)
+			}
+		} else if state != task.Leased {
+			releaseLease(taskToSet.Id)
+		}
 	}
 	datastoreMutex.Unlock()
 
@@ -207,15 +467,77 @@ func (h *Handler) SetById(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error: Wrong input")
 		return
+	} else if transitionErr != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: ", transitionErr)
+		return
+	} else if storeErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", storeErr)
+		log.Error("Couldn't store task", nlog.Data{"err": storeErr, "id": taskToSet.Id})
+		return
 	}
 
 	fmt.Fprint(w, "success")
 }
 
-func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
-	datastoreMutex.RLock()
-	defer datastoreMutex.RUnlock()
-	for key, value := range datastore {
-		fmt.Fprintln(w, key, ": ", "id:", value.Id, " state:", value.State)
+// SetPriority changes the priority of a task that isn't done yet. A queued
+// task keeps the priority it gained while waiting.
+func (h *Handler) SetPriority(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	id, err := task.ParseID(values.Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	priority, err := strconv.Atoi(values.Get("priority"))
+	if err != nil || priority < task.MinPriority || priority > task.MaxPriority {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: Priority must be a number in [%v, %v]", task.MinPriority, task.MaxPriority)
+		return
 	}
+
+	bErrored := false
+	bDone := false
+
+	datastoreMutex.Lock()
+	if taskToSet, ok := datastore[id]; !ok {
+		bErrored = true
+	} else if taskToSet.State.Terminal() {
+		bDone = true
+	} else {
+		taskToSet.Priority = priority
+		err = storeTask(taskToSet)
+	}
+	datastoreMutex.Unlock()
+
+	if bErrored {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Wrong input")
+		return
+	} else if bDone {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error: Task is already done")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Couldn't store task", nlog.Data{"err": err, "id": id})
+		return
+	}
+
+	log.Info("Task priority changed", nlog.Data{"id": id, "priority": priority})
+	fmt.Fprint(w, "success")
 }
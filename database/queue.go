@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// pendingQueue is a binary heap of the queued tasks, the one to hand out
+// next on top. It also indexes every task's position in the heap, so that a
+// task leaving the queued state can be taken out of it wherever it is.
+// Adding, taking the next and removing a task are all O(log n).
+//
+// Tasks are ordered by priority, aged by how long they've been waiting: a
+// task gains one priority level every agingStep spent in the queue. As all
+// tasks age at the same rate this order never changes while they wait, so
+// every task gets a fixed key when it's queued: the time it was queued,
+// moved back by agingStep for every level of priority. Smaller keys go
+// first, ties in id order.
+type pendingQueue struct {
+	tasks []pendingTask
+	index map[task.ID]int
+}
+
+type pendingTask struct {
+	id  task.ID
+	key int64
+}
+
+var (
+	// The queued tasks that are due, guarded by datastoreMutex. storeTask
+	// keeps it in step with the datastore.
+	pending = newPendingQueue()
+
+	// The queued tasks that aren't due yet, keyed by their NotBefore time.
+	// They're moved to pending as soon as they're due and a worker asks for
+	// a task.
+	delayed = newPendingQueue()
+
+	// How long a task waits in the queue to gain one priority level.
+	agingStep time.Duration
+)
+
+func newPendingQueue() *pendingQueue {
+	return &pendingQueue{index: make(map[task.ID]int)}
+}
+
+// heap.Interface, not to be called directly...
+
+func (q *pendingQueue) Len() int { return len(q.tasks) }
+
+func (q *pendingQueue) Less(i, j int) bool {
+	if q.tasks[i].key != q.tasks[j].key {
+		return q.tasks[i].key < q.tasks[j].key
+	}
+	return q.tasks[i].id.Less(q.tasks[j].id)
+}
+
+func (q *pendingQueue) Swap(i, j int) {
+	q.tasks[i], q.tasks[j] = q.tasks[j], q.tasks[i]
+	q.index[q.tasks[i].id] = i
+	q.index[q.tasks[j].id] = j
+}
+
+func (q *pendingQueue) Push(x interface{}) {
+	t := x.(pendingTask)
+	q.index[t.id] = len(q.tasks)
+	q.tasks = append(q.tasks, t)
+}
+
+func (q *pendingQueue) Pop() interface{} {
+	last := len(q.tasks) - 1
+	t := q.tasks[last]
+	q.tasks = q.tasks[:last]
+	delete(q.index, t.id)
+	return t
+}
+
+// set puts the task in the queue with the given key, or moves it if it's
+// already there.
+func (q *pendingQueue) set(id task.ID, key int64) {
+	if i, ok := q.index[id]; ok {
+		if q.tasks[i].key != key {
+			q.tasks[i].key = key
+			heap.Fix(q, i)
+		}
+		return
+	}
+	heap.Push(q, pendingTask{id: id, key: key})
+}
+
+// remove takes the task out of the queue if it's there.
+func (q *pendingQueue) remove(id task.ID) {
+	if i, ok := q.index[id]; ok {
+		heap.Remove(q, i)
+	}
+}
+
+// next returns the task to hand out next without taking it out of the queue.
+func (q *pendingQueue) next() (task.ID, bool) {
+	if len(q.tasks) == 0 {
+		return "", false
+	}
+	return q.tasks[0].id, true
+}
+
+// trackTask updates the queues after t was stored.
+func trackTask(t task.Task) {
+	if t.State != task.Queued {
+		pending.remove(t.Id)
+		delayed.remove(t.Id)
+	} else if t.NotBefore != nil && t.NotBefore.After(time.Now()) {
+		pending.remove(t.Id)
+		delayed.set(t.Id, t.NotBefore.UnixNano())
+	} else {
+		delayed.remove(t.Id)
+		pending.set(t.Id, queuedSince(t).UnixNano()-int64(t.Priority)*int64(agingStep))
+	}
+}
+
+// promoteDueTasks moves the delayed tasks that are due by now to pending.
+func promoteDueTasks(now time.Time) {
+	for delayed.Len() > 0 && delayed.tasks[0].key <= now.UnixNano() {
+		id := delayed.tasks[0].id
+		delayed.remove(id)
+		trackTask(datastore[id])
+	}
+}
+
+// queuedSince returns when the queued task t entered the queue. A delayed
+// task only starts to age once it's due.
+func queuedSince(t task.Task) time.Time {
+	since := time.Now()
+	if len(t.History) != 0 {
+		since = t.History[len(t.History)-1].At
+	} else if t.CreatedAt != nil {
+		since = *t.CreatedAt
+	}
+	if t.NotBefore != nil && t.NotBefore.After(since) {
+		return *t.NotBefore
+	}
+	return since
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+const benchQueueSize = 1000000
+
+// benchQueue returns a queue of n tasks with random keys, and their ids.
+func benchQueue(n int) (*pendingQueue, []task.ID) {
+	q := newPendingQueue()
+	ids := make([]task.ID, n)
+	for i := range ids {
+		ids[i] = task.NewID()
+		q.set(ids[i], rand.Int63())
+	}
+	return q, ids
+}
+
+func BenchmarkPendingQueue(b *testing.B) {
+	q, ids := benchQueue(benchQueueSize)
+
+	b.Run("set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q.set(ids[i%len(ids)], rand.Int63())
+		}
+	})
+	b.Run("next", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q.next()
+		}
+	})
+	b.Run("remove", func(b *testing.B) {
+		// Every task removed is put back, so that the queue stays as big.
+		for i := 0; i < b.N; i++ {
+			id := ids[i%len(ids)]
+			q.remove(id)
+			q.set(id, rand.Int63())
+		}
+	})
+}
+
+// BenchmarkGetNewTask leases tasks from a queue of at least benchQueueSize
+// tasks, from many goroutines at once. There's no log, so only the work
+// done under datastoreMutex is measured, not the fsync.
+func BenchmarkGetNewTask(b *testing.B) {
+	n := benchQueueSize
+	if b.N > n {
+		n = b.N
+	}
+
+	datastoreMutex.Lock()
+	datastore = make(map[task.ID]task.Task, n)
+	pending = newPendingQueue()
+	leases = make(map[task.ID]time.Time)
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		t := task.Task{Id: task.NewID(), State: task.Queued, Priority: rand.Intn(task.MaxPriority), CreatedAt: &now}
+		datastore[t.Id] = t
+		trackTask(t)
+	}
+	datastoreMutex.Unlock()
+
+	h := NewHandler()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			h.GetNewTask(w, httptest.NewRequest("GET", "/getNewTask?worker=bench", nil))
+			if w.Code != 200 {
+				b.Errorf("got HTTP status %v: %v", w.Code, w.Body)
+				return
+			}
+		}
+	})
+}
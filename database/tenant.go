@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// The master may cap how many unfinished (waiting, queued or leased) tasks a
+// tenant has at once, passing the cap along with new tasks as "maxTasks".
+// The database counts them, so the check can't race with other
+// submissions.
+
+// unfinishedTasks counts the unfinished tasks of every tenant, guarded by
+// datastoreMutex.
+var unfinishedTasks = make(map[string]int)
+
+// countTask updates unfinishedTasks for t, which was old before (if it
+// existed). It must be called with datastoreMutex held.
+func countTask(old task.Task, existed bool, t task.Task) {
+	if existed && !old.State.Terminal() {
+		unfinishedTasks[old.Tenant]--
+		if unfinishedTasks[old.Tenant] == 0 {
+			delete(unfinishedTasks, old.Tenant)
+		}
+	}
+	if !t.State.Terminal() {
+		unfinishedTasks[t.Tenant]++
+	}
+}
+
+// maxTasksFromQuery returns the "maxTasks" cap, 0 if there's none.
+func maxTasksFromQuery(values url.Values) (int, error) {
+	maxTasksStr := values.Get("maxTasks")
+	if len(maxTasksStr) == 0 {
+		return 0, nil
+	}
+	maxTasks, err := strconv.Atoi(maxTasksStr)
+	if err != nil || maxTasks < 0 {
+		return 0, fmt.Errorf("wrong maxTasks %q", maxTasksStr)
+	}
+	return maxTasks, nil
+}
+
+// checkTaskLimit fails if creating the given number of new tasks per tenant
+// would take any of them over maxTasks (if it isn't 0). It must be called
+// with datastoreMutex held.
+func checkTaskLimit(newTasks map[string]int, maxTasks int) error {
+	if maxTasks == 0 {
+		return nil
+	}
+	for tenant, n := range newTasks {
+		if unfinishedTasks[tenant]+n > maxTasks {
+			return fmt.Errorf("tenant %q can't have more than %v unfinished tasks", tenant, maxTasks)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// The datastore is made durable with a write-ahead log and snapshots kept in
+// dataDir. Every change to a task is appended to the current log segment
+// (wal-<seq>.log) as the task's new value, or as a purge of the task, and
+// fsynced before it's applied in memory. Snapshots (snapshot.json) hold the
+// whole datastore as of the end of segment walSeq; segments up to that one
+// are deleted once the snapshot is safely on disk. On startup the snapshot
+// is loaded and the newer segments are replayed on top of it.
+
+type walRecord struct {
+	// What happened to Task: empty if it was stored, otherwise one of the
+	// operations below, in which case only its id is set.
+	Op             string    `json:"op,omitempty"`
+	Task           task.Task `json:"task"`
+	LastLeaseToken int64     `json:"lastLeaseToken"`
+
+	// The sequence number of the last change feed event caused by storing
+	// Task, if any.
+	LastEventSeq int64 `json:"lastEventSeq,omitempty"`
+}
+
+const (
+	opPurge  = "purge"  // the task was purged, its images are still to be deleted
+	opForget = "forget" // the images of the purged task were deleted
+)
+
+type snapshot struct {
+	WalSeq         int         `json:"walSeq"`
+	LastLeaseToken int64       `json:"lastLeaseToken"`
+	LastEventSeq   int64       `json:"lastEventSeq"`
+	Tasks          []task.Task `json:"tasks"`
+	Tombstones     []task.ID   `json:"tombstones,omitempty"`
+}
+
+const snapshotFile = "snapshot.json"
+
+var (
+	dataDir string
+
+	// The open log segment and its number, guarded by datastoreMutex.
+	wal    *os.File
+	walSeq int
+
+	// Set once a failed append to segment walErrSeq couldn't be undone. The
+	// segment may hold a torn or unapplied record then, so nothing more is
+	// logged (nor changed) until a snapshot makes the segment redundant.
+	// Guarded by datastoreMutex.
+	walErr    error
+	walErrSeq int
+)
+
+// storeTask logs t and then puts it in the datastore, moving along the
+// tasks depending on it if it's done. Nothing changes in memory if it can't
+// be logged. It must be called with datastoreMutex held.
+func storeTask(t task.Task) error {
+	return storeTasks([]task.Task{t})
+}
+
+// storeTasks is storeTask for many tasks at once, logged with a single
+// fsync. Either all of them are stored or none.
+func storeTasks(ts []task.Task) error {
+	records := make([]walRecord, len(ts))
+	seq := lastEventSeq
+	for i, t := range ts {
+		ts[i].Version = datastore[t.Id].Version + 1
+		seq += int64(len(newTransitions(datastore[t.Id], t)))
+		records[i] = walRecord{Task: ts[i], LastEventSeq: seq}
+	}
+	if err := appendRecords(records...); err != nil {
+		return err
+	}
+
+	for i, t := range ts {
+		t = records[i].Task
+		old, ok := datastore[t.Id]
+		if !ok {
+			indexTask(t.Id)
+		}
+		datastore[t.Id] = t
+		countTask(old, ok, t)
+		publishEvents(t, newTransitions(old, t), records[i].LastEventSeq)
+	}
+	// Settling stores more tasks, whose events come after all of these.
+	for _, t := range ts {
+		t = datastore[t.Id]
+		trackTask(t)
+		settleChildren(t)
+	}
+	return nil
+}
+
+// appendRecords logs records. It must be called with datastoreMutex held.
+func appendRecords(records ...walRecord) error {
+	if wal == nil {
+		return nil
+	}
+	if walErr != nil {
+		return walErr
+	}
+
+	data := []byte{}
+	for _, record := range records {
+		record.LastLeaseToken = lastLeaseToken
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = wal.Write(data); err == nil {
+		err = wal.Sync()
+	}
+	if err != nil {
+		// Replay only copes with a torn record at the very end, and records
+		// that were never applied mustn't come back on a restart either.
+		if truncErr := undoAppend(info.Size()); truncErr != nil {
+			walErr = fmt.Errorf("log segment %v can't be repaired: %v", walSeq, truncErr)
+			walErrSeq = walSeq
+			log.Error("Stopped logging", nlog.Data{"err": err, "truncErr": truncErr, "segment": walSeq})
+		}
+		return err
+	}
+	return nil
+}
+
+// undoAppend cuts the open log segment back to size.
+func undoAppend(size int64) error {
+	if err := wal.Truncate(size); err != nil {
+		return err
+	}
+	return wal.Sync()
+}
+
+// applyRecord replays record on the datastore.
+func applyRecord(record walRecord) {
+	id := record.Task.Id
+	switch record.Op {
+	case opPurge:
+		delete(datastore, id)
+		tombstones[id] = true
+	case opForget:
+		delete(tombstones, id)
+	default:
+		// Tasks stored before they had versions.
+		if record.Task.Version == 0 {
+			record.Task.Version = 1
+		}
+		if record.LastEventSeq != 0 {
+			publishEvents(record.Task, newTransitions(datastore[id], record.Task), record.LastEventSeq)
+		}
+		datastore[id] = record.Task
+	}
+
+	if record.LastLeaseToken > lastLeaseToken {
+		lastLeaseToken = record.LastLeaseToken
+	}
+}
+
+// openDatastore recovers the datastore from dir and starts a new log
+// segment there.
+func openDatastore(dir string) error {
+	dataDir = dir
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+
+	covered, err := loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	segments, err := walSegments()
+	if err != nil {
+		return err
+	}
+	walSeq = covered
+	for _, seq := range segments {
+		if seq <= covered {
+			os.Remove(walPath(seq))
+			continue
+		}
+		if err = replaySegment(seq); err != nil {
+			return err
+		}
+		walSeq = seq
+	}
+
+	reindexTasks()
+
+	if err = openSegment(walSeq + 1); err != nil {
+		return err
+	}
+
+	// Lease deadlines aren't logged. Give the workers that held tasks when we
+	// went down a full lease to renew, before they're requeued.
+	for id, t := range datastore {
+		trackTask(t)
+		linkTask(t)
+		rememberIdempotencyKey(t)
+		countTask(task.Task{}, false, t)
+		if t.State == task.Leased {
+			extendLease(id)
+		}
+	}
+
+	// We may have gone down before all the children of a finished task were
+	// moved along.
+	for _, t := range datastore {
+		settleChildren(t)
+	}
+
+	log.Info("Datastore recovered", nlog.Data{"tasks": len(datastore), "lastLeaseToken": lastLeaseToken, "lastEventSeq": lastEventSeq, "walSeq": walSeq})
+	return nil
+}
+
+func loadSnapshot() (int, error) {
+	file, err := os.Open(filepath.Join(dataDir, snapshotFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	s := snapshot{}
+	if err = json.NewDecoder(bufio.NewReader(file)).Decode(&s); err != nil {
+		return 0, fmt.Errorf("reading snapshot: %v", err)
+	}
+
+	lastLeaseToken = s.LastLeaseToken
+	lastEventSeq = s.LastEventSeq
+	for _, t := range s.Tasks {
+		applyRecord(walRecord{Task: t})
+	}
+	for _, id := range s.Tombstones {
+		applyRecord(walRecord{Op: opPurge, Task: task.Task{Id: id}})
+	}
+	return s.WalSeq, nil
+}
+
+func replaySegment(seq int) error {
+	file, err := os.Open(walPath(seq))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) != 0 {
+				// The last record never made it to disk completely, so it was
+				// never acknowledged either.
+				log.Info("Ignoring torn record at the end of the log", nlog.Data{"segment": seq, "line": line})
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		record := walRecord{}
+		if err = json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("log segment %v, line %v: %v", seq, line, err)
+		}
+		applyRecord(record)
+	}
+}
+
+// walSegments returns the numbers of the log segments in dataDir, in order.
+func walSegments() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []int{}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "wal-"), ".log")
+		seq, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func walPath(seq int) string {
+	return filepath.Join(dataDir, "wal-"+strconv.Itoa(seq)+".log")
+}
+
+// openSegment switches logging to a new segment. It must be called with
+// datastoreMutex held (or before the server starts).
+func openSegment(seq int) error {
+	file, err := os.OpenFile(walPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syncDir(dataDir); err != nil {
+		file.Close()
+		return err
+	}
+
+	if wal != nil {
+		wal.Close()
+	}
+	wal = file
+	walSeq = seq
+	return nil
+}
+
+// takeSnapshot writes the whole datastore to disk and drops the log segments
+// it makes redundant. Only the copying of the datastore blocks other
+// requests.
+func takeSnapshot() error {
+	datastoreMutex.Lock()
+	covered := walSeq
+	if err := openSegment(walSeq + 1); err != nil {
+		datastoreMutex.Unlock()
+		return err
+	}
+	s := snapshot{WalSeq: covered, LastLeaseToken: lastLeaseToken, LastEventSeq: lastEventSeq, Tasks: make([]task.Task, 0, len(datastore))}
+	for _, t := range datastore {
+		s.Tasks = append(s.Tasks, t)
+	}
+	for id := range tombstones {
+		s.Tombstones = append(s.Tombstones, id)
+	}
+	datastoreMutex.Unlock()
+
+	sort.Slice(s.Tasks, func(i, j int) bool { return s.Tasks[i].Id.Less(s.Tasks[j].Id) })
+	sort.Slice(s.Tombstones, func(i, j int) bool { return s.Tombstones[i].Less(s.Tombstones[j]) })
+
+	file, err := os.Create(filepath.Join(dataDir, snapshotFile+".tmp"))
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = json.NewEncoder(writer).Encode(s)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(file.Name(), filepath.Join(dataDir, snapshotFile)); err != nil {
+		return err
+	}
+	if err = syncDir(dataDir); err != nil {
+		return err
+	}
+
+	segments, err := walSegments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq <= covered {
+			os.Remove(walPath(seq))
+		}
+	}
+
+	datastoreMutex.Lock()
+	if walErr != nil && walErrSeq <= covered {
+		walErr = nil
+		log.Info("Logging resumed, the broken log segment is covered by the snapshot", nlog.Data{"segment": walErrSeq})
+	}
+	datastoreMutex.Unlock()
+
+	log.Info("Snapshot taken", nlog.Data{"tasks": len(s.Tasks), "walSeq": covered})
+	return nil
+}
+
+func snapshotPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := takeSnapshot(); err != nil {
+			log.Error("Couldn't take snapshot", nlog.Data{"err": err})
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// Stands for a task that was purged in the expected states.
+const purged task.State = -1
+
+// resetDatastore forgets everything in memory, as after a restart.
+func resetDatastore() {
+	if wal != nil {
+		wal.Close()
+	}
+	wal, walSeq, walErr, walErrSeq = nil, 0, nil, 0
+
+	datastore = make(map[task.ID]task.Task)
+	tombstones = make(map[task.ID]bool)
+	children = make(map[task.ID][]task.ID)
+	idempotencyKeys = make(map[string]task.ID)
+	unfinishedTasks = make(map[string]int)
+	leases = make(map[task.ID]time.Time)
+	pending, delayed = newPendingQueue(), newPendingQueue()
+	taskIds = nil
+
+	lastLeaseToken, lastEventSeq = 0, 0
+	events = nil
+	feedSize = 100
+}
+
+// walTest builds the state of one test case with the helpers below, which
+// fail it on any error.
+type walTest struct {
+	t   *testing.T
+	ids []task.ID
+}
+
+// create stores a new queued task and returns its id.
+func (w *walTest) create() task.ID {
+	t := task.Task{Id: task.NewID()}
+	createTask(&t, task.Queued)
+	w.store(t)
+	w.ids = append(w.ids, t.Id)
+	return t.Id
+}
+
+func (w *walTest) move(id task.ID, to task.State) {
+	datastoreMutex.Lock()
+	t := datastore[id]
+	datastoreMutex.Unlock()
+
+	if err := moveTask(&t, to, "test", ""); err != nil {
+		w.t.Fatal(err)
+	}
+	if to == task.Leased {
+		datastoreMutex.Lock()
+		t.LeaseToken = grantLease(id)
+		datastoreMutex.Unlock()
+	}
+	w.store(t)
+}
+
+func (w *walTest) store(t task.Task) {
+	datastoreMutex.Lock()
+	defer datastoreMutex.Unlock()
+	if err := storeTask(t); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func (w *walTest) snapshot() {
+	if err := takeSnapshot(); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+// appendToLog writes data at the end of the open log segment, behind the
+// datastore's back.
+func (w *walTest) appendToLog(data string) {
+	file, err := os.OpenFile(walPath(walSeq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(data); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(w *walTest)
+
+		// What the datastore holds after reopening it.
+		states         []task.State
+		tombstones     int
+		lastLeaseToken int64
+		lastEventSeq   int64
+		segments       []int // log segments left on disk, before reopening
+		wantErr        bool
+	}{
+		{
+			name:   "empty",
+			build:  func(w *walTest) {},
+			states: []task.State{},
+			// openDatastore starts segment 1 straight away.
+			segments: []int{1},
+		},
+		{
+			name: "replay",
+			build: func(w *walTest) {
+				w.create()
+				id := w.create()
+				w.move(id, task.Leased)
+				w.move(id, task.Finished)
+			},
+			states:         []task.State{task.Queued, task.Finished},
+			lastLeaseToken: 1,
+			lastEventSeq:   4,
+			segments:       []int{1},
+		},
+		{
+			name: "torn tail",
+			build: func(w *walTest) {
+				id := w.create()
+				w.move(id, task.Leased)
+				w.appendToLog(`{"task":{"id":"`)
+			},
+			states:         []task.State{task.Leased},
+			lastLeaseToken: 1,
+			lastEventSeq:   2,
+			segments:       []int{1},
+		},
+		{
+			name: "corrupt record",
+			build: func(w *walTest) {
+				w.create()
+				w.appendToLog("{not json}\n")
+				w.create()
+			},
+			segments: []int{1},
+			wantErr:  true,
+		},
+		{
+			name: "snapshot drops covered segments",
+			build: func(w *walTest) {
+				id := w.create()
+				w.move(id, task.Leased)
+				w.snapshot()
+				w.create()
+				w.snapshot()
+				w.move(id, task.Queued)
+			},
+			states:         []task.State{task.Queued, task.Queued},
+			lastLeaseToken: 1,
+			lastEventSeq:   4,
+			segments:       []int{3},
+		},
+		{
+			name: "purge",
+			build: func(w *walTest) {
+				id := w.create()
+				w.move(id, task.Cancelled)
+				w.create()
+				purgeTasks(time.Now().Add(time.Hour))
+			},
+			states:       []task.State{purged, task.Queued},
+			tombstones:   1,
+			lastEventSeq: 3,
+			segments:     []int{1},
+		},
+		{
+			name: "purge in snapshot",
+			build: func(w *walTest) {
+				id := w.create()
+				w.move(id, task.Cancelled)
+				purgeTasks(time.Now().Add(time.Hour))
+				w.snapshot()
+			},
+			states:       []task.State{purged},
+			tombstones:   1,
+			lastEventSeq: 2,
+			segments:     []int{2},
+		},
+		{
+			name: "broken segment covered by a snapshot",
+			build: func(w *walTest) {
+				id := w.create()
+
+				// Appends to a read-only file fail, and so does undoing
+				// them: logging stops.
+				readOnly, err := os.Open(walPath(walSeq))
+				if err != nil {
+					w.t.Fatal(err)
+				}
+				wal.Close()
+				wal = readOnly
+				t := datastore[id]
+				moveTask(&t, task.Cancelled, "", "")
+				datastoreMutex.Lock()
+				err = storeTask(t)
+				datastoreMutex.Unlock()
+				if err == nil || walErr == nil {
+					w.t.Fatalf("storing to a read-only log succeeded, walErr %v", walErr)
+				}
+				datastoreMutex.Lock()
+				err = storeTask(t)
+				datastoreMutex.Unlock()
+				if err != walErr {
+					w.t.Fatalf("storing with a broken log returned %v, want %v", err, walErr)
+				}
+
+				w.snapshot()
+				if walErr != nil {
+					w.t.Fatalf("walErr %v after the snapshot", walErr)
+				}
+				w.move(id, task.Leased)
+			},
+			states:         []task.State{task.Leased},
+			lastLeaseToken: 1,
+			lastEventSeq:   2,
+			segments:       []int{2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			resetDatastore()
+			defer resetDatastore()
+			if err := openDatastore(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			w := &walTest{t: t}
+			test.build(w)
+
+			segments, err := walSegments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalInts(segments, test.segments) {
+				t.Errorf("segments %v, want %v", segments, test.segments)
+			}
+
+			resetDatastore()
+			err = openDatastore(dir)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("reopening succeeded, want an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(datastore) != countStored(test.states) {
+				t.Errorf("%v tasks, want %v", len(datastore), countStored(test.states))
+			}
+			for i, id := range w.ids {
+				got, ok := datastore[id]
+				if test.states[i] == purged {
+					if ok {
+						t.Errorf("task %v is back in state %v, want it purged", i, got.State)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("task %v is missing", i)
+				} else if got.State != test.states[i] {
+					t.Errorf("task %v in state %v, want %v", i, got.State, test.states[i])
+				}
+			}
+			if len(tombstones) != test.tombstones {
+				t.Errorf("%v tombstones, want %v", len(tombstones), test.tombstones)
+			}
+			if lastLeaseToken != test.lastLeaseToken {
+				t.Errorf("lastLeaseToken %v, want %v", lastLeaseToken, test.lastLeaseToken)
+			}
+			if lastEventSeq != test.lastEventSeq {
+				t.Errorf("lastEventSeq %v, want %v", lastEventSeq, test.lastEventSeq)
+			}
+		})
+	}
+}
+
+func countStored(states []task.State) int {
+	n := 0
+	for _, state := range states {
+		if state != purged {
+			n++
+		}
+	}
+	return n
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,12 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/pmalek/nlog"
 )
 
-const indexPage = "<html><head><title>Upload file</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
+const indexPage = "<html><head><title>Upload file</title></head><body><form enctype=\"multipart/form-data\" action=\"submitTask\" method=\"post\"> <input type=\"file\" name=\"uploadfile\" /> <input type=\"text\" name=\"operations\" placeholder=\"[{&quot;name&quot;: &quot;grayscale&quot;}]\" /> <select name=\"format\"><option value=\"\">same as input</option><option>png</option><option>jpeg</option><option>gif</option></select> <input type=\"number\" name=\"priority\" min=\"-100\" max=\"100\" placeholder=\"priority\" /> <input type=\"text\" name=\"delay\" placeholder=\"delay, e.g. 2h\" /> <input type=\"text\" name=\"dependsOn\" placeholder=\"depends on, e.g. 01ARZ3NDEKTSV4RRFFQ69G5FAV\" /> <input type=\"password\" name=\"apiKey\" placeholder=\"API key\" /> <input type=\"submit\" value=\"upload\" /> </form> </body> </html>"
 
 var (
 	keyValueStoreAddress string
@@ -62,8 +63,9 @@ func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/", handleIndex)
 	r.HandleFunc("/submitTask", handleTask).Methods(http.MethodPost)
-	r.HandleFunc("/isReady", handleCheckForReadiness).Methods(http.MethodGet)
-	r.HandleFunc("/getImage", serveImage).Methods(http.MethodGet)
+	// POST lets browser forms send the API key in the body.
+	r.HandleFunc("/isReady", handleCheckForReadiness).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/getImage", serveImage).Methods(http.MethodGet, http.MethodPost)
 
 	log.Infof("Starting frontend at :8000 ...")
 	http.ListenAndServe(":8000", r)
@@ -84,24 +86,42 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A task depending on others takes their result as input instead of an
+	// upload.
+	var image io.Reader
 	file, _, err := r.FormFile("uploadfile")
-
-	if err != nil {
+	if err == nil {
+		image = file
+	} else if err != http.ErrMissingFile || len(r.FormValue("dependsOn")) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Wrong input")
 		log.Errorf("Wrong input")
 		return
 	}
 
-	response, err := http.Post("http://"+masterLocation+"/new", "image", file)
+	query := url.Values{}
+	for _, key := range []string{"operations", "renditions", "format", "quality", "priority", "notBefore", "delay", "dependsOn", "tenant", "idempotencyKey"} {
+		if value := r.FormValue(key); len(value) != 0 {
+			query.Set(key, value)
+		}
+	}
+	// Lets a client retry a submission that timed out without creating the
+	// task twice.
+	if key := r.Header.Get("Idempotency-Key"); len(key) != 0 && len(query.Get("idempotencyKey")) == 0 {
+		query.Set("idempotencyKey", key)
+	}
+
+	response, err := callMaster(r, http.MethodPost, "/new?"+query.Encode(), image)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
-		log.Errorf("Wrong input", nlog.Data{"err": err, "response.StatusCode": response.StatusCode})
+		log.Errorf("Wrong input", nlog.Data{"err": err})
 		return
 	} else if response.StatusCode != http.StatusOK {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Error:", err)
+		// Master's answer says what's wrong: a bad spec, a missing API key,
+		// a tenant over its limits...
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
 		log.Errorf("Wrong input", nlog.Data{"response.StatusCode": response.StatusCode})
 		return
 	}
@@ -113,26 +133,33 @@ func handleTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if replayed := response.Header.Get("Idempotent-Replayed"); len(replayed) != 0 {
+		w.Header().Set("Idempotent-Replayed", replayed)
+	}
 	fmt.Fprint(w, string(data))
 }
 
 func handleCheckForReadiness(w http.ResponseWriter, r *http.Request) {
-	values, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
+	if err := r.ParseForm(); err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
+	values := r.Form
 	if len(values.Get("id")) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Wrong input")
 		return
 	}
 
-	response, err := http.Get("http://" + masterLocation + "/isReady?id=" + values.Get("id") + "&state=finished")
-	if err != nil || response.StatusCode != http.StatusOK {
+	response, err := callMaster(r, http.MethodGet, "/isReady?id="+url.QueryEscape(values.Get("id"))+"&state=finished", nil)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
 		return
+	} else if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
+		return
 	}
 
 	data, err := ioutil.ReadAll(response.Body)
@@ -142,22 +169,31 @@ func handleCheckForReadiness(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch string(data) {
+	status := strings.SplitN(string(data), "\n", 2)
+	switch status[0] {
 	case "0":
 		fmt.Fprint(w, "Your image is not ready yet.")
 	case "1":
 		fmt.Fprint(w, "Your image is ready.")
+	case "2":
+		reason := "unknown error"
+		if len(status) > 1 && len(status[1]) != 0 {
+			reason = status[1]
+		}
+		fmt.Fprint(w, "Processing your image failed: ", reason)
+	case "3":
+		fmt.Fprint(w, "Your image was cancelled.")
 	default:
 		fmt.Fprint(w, "Internal server error.")
 	}
 }
 
 func serveImage(w http.ResponseWriter, r *http.Request) {
-	values, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
+	if err := r.ParseForm(); err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
+	values := r.Form
 	if len(values.Get("id")) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Wrong input")
@@ -165,14 +201,27 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := http.Get("http://" + masterLocation + "/get?id=" + values.Get("id") + "&state=finished")
-	if err != nil || response.StatusCode != http.StatusOK {
+	query := url.Values{}
+	query.Set("id", values.Get("id"))
+	if variant := values.Get("variant"); len(variant) != 0 {
+		query.Set("variant", variant)
+	}
+
+	response, err := callMaster(r, http.MethodGet, "/get?"+query.Encode(), nil)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
 		log.Error("Wrong input", nlog.Data{"err": err})
 		return
+	} else if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
+		return
 	}
 
+	if contentType := response.Header.Get("Content-Type"); len(contentType) != 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
 	_, err = io.Copy(w, response.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -181,3 +230,26 @@ func serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// callMaster sends a request to master on behalf of the tenant r comes from,
+// identified by its API key: the X-Api-Key header or, for plain browser
+// forms, the "apiKey" field of a POSTed form. Keys in the URL aren't
+// accepted, they'd end up in logs and browser histories.
+func callMaster(r *http.Request, method, path string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, "http://"+masterLocation+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "image")
+	}
+
+	key := r.Header.Get("X-Api-Key")
+	if len(key) == 0 {
+		key = r.PostFormValue("apiKey")
+	}
+	if len(key) != 0 {
+		request.Header.Set("X-Api-Key", key)
+	}
+	return http.DefaultClient.Do(request)
+}
@@ -0,0 +1,114 @@
+package imageformat
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+)
+
+type Format struct {
+	Name        string
+	Extension   string
+	ContentType string
+}
+
+var (
+	PNG  = Format{Name: "png", Extension: ".png", ContentType: "image/png"}
+	JPEG = Format{Name: "jpeg", Extension: ".jpg", ContentType: "image/jpeg"}
+	GIF  = Format{Name: "gif", Extension: ".gif", ContentType: "image/gif"}
+
+	formats = []Format{PNG, JPEG, GIF}
+
+	// Operations work on a single image, so animations are refused rather
+	// than cut down to their first frame.
+	ErrAnimated = errors.New("animated GIFs aren't supported")
+)
+
+// ByName returns the format registered under name ("png", "jpeg", "gif").
+// "jpg" is accepted as an alias for "jpeg".
+func ByName(name string) (Format, bool) {
+	if name == "jpg" {
+		name = JPEG.Name
+	}
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+func ByExtension(ext string) (Format, bool) {
+	for _, f := range formats {
+		if f.Extension == ext {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Sniff detects the format from the first bytes of an encoded image. At most
+// 512 bytes are looked at.
+func Sniff(data []byte) (Format, bool) {
+	contentType := http.DetectContentType(data)
+	for _, f := range formats {
+		if f.ContentType == contentType {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Decode decodes an image in any of the supported formats and reports which
+// one it was. GIFs with more than one frame fail with ErrAnimated.
+func Decode(r io.Reader) (image.Image, Format, error) {
+	reader := bufio.NewReader(r)
+	if head, _ := reader.Peek(512); isGIF(head) {
+		all, err := gif.DecodeAll(reader)
+		if err != nil {
+			return nil, Format{}, err
+		}
+		if len(all.Image) > 1 {
+			return nil, Format{}, ErrAnimated
+		}
+		return all.Image[0], GIF, nil
+	}
+
+	img, name, err := image.Decode(reader)
+	if err != nil {
+		return nil, Format{}, err
+	}
+
+	f, ok := ByName(name)
+	if !ok {
+		return nil, Format{}, errors.New("unsupported image format " + name)
+	}
+	return img, f, nil
+}
+
+func isGIF(head []byte) bool {
+	f, ok := Sniff(head)
+	return ok && f == GIF
+}
+
+// Encode writes img in format f. quality is only used by JPEG; zero means
+// the encoder's default.
+func Encode(w io.Writer, img image.Image, f Format, quality int) error {
+	switch f.Name {
+	case PNG.Name:
+		return png.Encode(w, img)
+	case JPEG.Name:
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case GIF.Name:
+		return gif.Encode(w, img, nil)
+	}
+	return errors.New("unsupported image format " + f.Name)
+}
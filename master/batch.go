@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+const (
+	// The most images uploaded in one /newBatch call, as many as the
+	// database creates at once.
+	maxBatchSize = 1000
+
+	// Workers keep asking for tasks as long as they find some, so a batch
+	// needs no more notifications than there are workers to wake.
+	maxBatchNotifications = 100
+
+	// Uploads bigger than this are buffered on disk rather than in memory.
+	maxBatchMemory = 32 << 20
+)
+
+// NewBatch creates a task for every image in the multipart/form-data body
+// (all under "uploadfile") and answers with the JSON list of their ids, in
+// the same order. The query holds the spec shared by all of them, as for
+// /new. The tasks are created in a single call to the database. If any
+// image can't be stored, all the tasks are cancelled and the batch fails as
+// a whole.
+func (h *Handler) NewBatch(w http.ResponseWriter, r *http.Request) {
+	myTenant, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	spec, err := taskSpecFromQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Wrong task spec", nlog.Data{"err": err, "values": values})
+		return
+	}
+	if len(spec.DependsOn) != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Tasks in a batch can't depend on others")
+		return
+	}
+	if len(spec.IdempotencyKey) != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Idempotency keys aren't supported in batches")
+		return
+	}
+	if !assignTenant(w, &spec, myTenant) || !checkStorageQuota(w, myTenant) {
+		return
+	}
+
+	if err = r.ParseMultipartForm(maxBatchMemory); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["uploadfile"]
+	if len(files) == 0 || len(files) > maxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: A batch holds between 1 and %v images", maxBatchSize)
+		return
+	}
+
+	specs := make([]task.Task, len(files))
+	for i := range specs {
+		specs[i] = spec
+	}
+	specsJson, err := json.Marshal(specs)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/newTasks"+tasksQuery(myTenant), "application/json", bytes.NewReader(specsJson))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		fmt.Fprint(w, "Error: ", string(data))
+		log.Error("Database refused the new tasks", nlog.Data{"response.StatusCode": response.StatusCode, "data": string(data)})
+		return
+	}
+
+	ids := []string{}
+	if err = json.Unmarshal(data, &ids); err != nil || len(ids) != len(files) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: Wrong answer from the database")
+		log.Error("Database returned wrong ids", nlog.Data{"err": err, "data": string(data)})
+		return
+	}
+
+	for i, header := range files {
+		if err = uploadFile(ids[i], header, myTenant); err != nil {
+			// The tasks are created already. The whole batch is cancelled,
+			// so that retrying it doesn't do any image twice.
+			for _, id := range ids {
+				cancelTask(id, "upload failed")
+			}
+			if err == errQuotaExceeded {
+				w.WriteHeader(http.StatusTooManyRequests)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			fmt.Fprintf(w, "Error: Image %v (task %v): %v", i, ids[i], err)
+			log.Error("Couldn't upload image", nlog.Data{"err": err, "id_str": ids[i]})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+
+	if len(ids) > maxBatchNotifications {
+		ids = ids[:maxBatchNotifications]
+	}
+	h.notifyWorkers(spec.NotBefore, ids...)
+}
+
+func uploadFile(id string, header *multipart.FileHeader, t tenant) error {
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return uploadImage(id, file, t)
+}
+
+// Statuses answers with the state of every task in the JSON list of ids in
+// the request body, see the database's /statuses. Tasks of other tenants
+// are answered as unknown.
+func (h *Handler) Statuses(w http.ResponseWriter, r *http.Request) {
+	myTenant, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	query := ""
+	if tenants != nil {
+		query = "?tenant=" + url.QueryEscape(myTenant.Name)
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/statuses"+query, "application/json", r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); len(contentType) != 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
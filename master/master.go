@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,8 +12,11 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pmalek/image_service/imageformat"
 	"github.com/pmalek/image_service/task"
 	"github.com/pmalek/nlog"
 )
@@ -49,23 +54,76 @@ func main() {
 	if ok := getSlavesAddressesFromDatabase(); ok == false {
 		return
 	}
+	if len(os.Args) > 3 {
+		if err := loadTenants(os.Args[3]); err != nil {
+			log.Error("Couldn't load tenants", nlog.Data{"err": err, "path": os.Args[3]})
+			return
+		}
+	}
 
 	h := &Handler{}
 	h.initializeWorkerConn()
 	defer h.client.Close()
 	r := mux.NewRouter()
 	r.HandleFunc("/new", h.NewImage).Methods(http.MethodPost)
+	r.HandleFunc("/newBatch", h.NewBatch).Methods(http.MethodPost)
+	r.HandleFunc("/statuses", h.Statuses).Methods(http.MethodPost)
 	r.HandleFunc("/get", h.GetImage)
 	r.HandleFunc("/isReady", h.IsReady)
 	r.HandleFunc("/getNewTask", h.GetNewTask)
 	r.HandleFunc("/registerTaskFinished", h.RegisterTaskFinished)
+	r.HandleFunc("/registerTaskFailed", h.RegisterTaskFailed).Methods(http.MethodPost)
+	r.HandleFunc("/renewLease", h.RenewLease).Methods(http.MethodPost)
+	r.HandleFunc("/setPriority", h.SetPriority).Methods(http.MethodPost)
 
 	log.Infof("Starting master server at :3003 ...")
 	http.ListenAndServe(":3003", r)
 }
 
 func (h *Handler) NewImage(w http.ResponseWriter, r *http.Request) {
-	response, err := http.Post("http://"+databaseLocation+"/newTask", "text/plain", nil)
+	myTenant, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); len(key) != 0 && len(values.Get("idempotencyKey")) == 0 {
+		values.Set("idempotencyKey", key)
+	}
+
+	spec, err := taskSpecFromQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error: ", err)
+		log.Error("Wrong task spec", nlog.Data{"err": err, "values": values})
+		return
+	}
+	if !assignTenant(w, &spec, myTenant) || !checkStorageQuota(w, myTenant) {
+		return
+	}
+	// The first parent's result is the input, so depending on another
+	// tenant's task would hand its image out. Such parents are answered as
+	// if they didn't exist.
+	if tenants != nil {
+		for _, parent := range spec.DependsOn {
+			if _, ok := ownTask(w, myTenant, string(parent)); !ok {
+				return
+			}
+		}
+	}
+	specJson, err := json.Marshal(spec)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/newTask"+tasksQuery(myTenant), "application/json", bytes.NewReader(specJson))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
@@ -80,28 +138,258 @@ func (h *Handler) NewImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id_str := string(id)
-	id_int, err := strconv.Atoi(id_str)
-	if err != nil {
+	if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		fmt.Fprint(w, "Error: ", id_str)
+		log.Error("Database refused the new task", nlog.Data{"response.StatusCode": response.StatusCode, "data": id_str})
+		return
+	}
+	if _, err = task.ParseID(id_str); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Error("id is not a parsable int", nlog.Data{"err": err, "id_str": id_str})
+		log.Error("Database returned a wrong id", nlog.Data{"err": err, "id_str": id_str})
 		return
 	}
 
-	_, err = http.Post("http://"+storageLocation+"/sendImage?id="+id_str+"&state=working", "image", r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Error:", err)
-		log.Error("", nlog.Data{"err": err, "id_str": id_str})
+	// The task was submitted before, its image is there already.
+	if response.Header.Get("Idempotent-Replayed") == "true" {
+		log.Info("Task submitted again", nlog.Data{"id_str": id_str, "idempotencyKey": spec.IdempotencyKey})
+		w.Header().Set("Idempotent-Replayed", "true")
+		fmt.Fprint(w, id_str)
 		return
 	}
+
+	// A task depending on others works on their result, storage serves it as
+	// the task's input. There's nothing to upload.
+	if len(spec.DependsOn) == 0 {
+		if err = uploadImage(id_str, r.Body, myTenant); err != nil {
+			cancelTask(id_str, "upload failed")
+			if err == errQuotaExceeded {
+				w.WriteHeader(http.StatusTooManyRequests)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			fmt.Fprint(w, "Error:", err)
+			log.Error("Couldn't upload image", nlog.Data{"err": err, "id_str": id_str})
+			return
+		}
+		// Submitting the key again only gets this task back from now on.
+		if len(spec.IdempotencyKey) != 0 {
+			markImageStored(id_str)
+		}
+	}
 	fmt.Fprint(w, id_str)
 
-	log.Info("Notifying workers that there is task to be done", nlog.Data{"id_int": id_int})
-	var result int
-	go h.client.Call("Notifier.Notify", id_int, &result)
+	h.notifyWorkers(spec.NotBefore, id_str)
+}
+
+// errQuotaExceeded means storage refused an image because its tenant would
+// use too much storage.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// uploadImage stores image as the input of task id, counting it towards the
+// storage of tenant t.
+func uploadImage(id string, image io.Reader, t tenant) error {
+	query := url.Values{}
+	query.Set("id", id)
+	query.Set("state", "working")
+	query.Set("tenant", t.Name)
+	if t.MaxBytes != 0 {
+		query.Set("maxBytes", strconv.FormatInt(t.MaxBytes, 10))
+	}
+
+	response, err := http.Post("http://"+storageLocation+"/sendImage?"+query.Encode(), "image", image)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		return errQuotaExceeded
+	} else if response.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("storage returned HTTP status %v: %s", response.StatusCode, data)
+	}
+	return nil
+}
+
+// markImageStored tells the database the image of task id was uploaded. If
+// that fails, the task is only created again if its key is submitted again.
+func markImageStored(id string) {
+	response, err := http.Post("http://"+databaseLocation+"/imageStored?id="+url.QueryEscape(id), "text/plain", nil)
+	if err != nil {
+		log.Error("Couldn't mark image stored", nlog.Data{"err": err, "id_str": id})
+		return
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Error("Couldn't mark image stored", nlog.Data{"response.StatusCode": response.StatusCode, "data": string(data), "id_str": id})
+	}
+}
+
+// A task that keeps changing under cancelTask is given up on after this
+// many tries.
+const maxCancelAttempts = 5
+
+// cancelTask cancels task id, which was created but can't be worked on.
+// That's only logged if it fails too: the task then fails once a worker
+// finds no image. A task that changed since it was read (409 from
+// /setById) is read again and cancelled from its new version, unless it's
+// done by then.
+func cancelTask(id, reason string) {
+	for attempt := 1; attempt <= maxCancelAttempts; attempt++ {
+		response, err := http.Get("http://" + databaseLocation + "/getById?id=" + id)
+		if err != nil {
+			log.Error("Couldn't cancel task", nlog.Data{"err": err, "id_str": id})
+			return
+		}
+		data, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || response.StatusCode != http.StatusOK {
+			log.Error("Couldn't cancel task", nlog.Data{"err": err, "id_str": id, "response.StatusCode": response.StatusCode})
+			return
+		}
+
+		myTask := task.Task{}
+		if err = json.Unmarshal(data, &myTask); err != nil {
+			log.Error("Couldn't cancel task", nlog.Data{"err": err, "id_str": id})
+			return
+		}
+		if myTask.State.Terminal() {
+			log.Info("Task to cancel is done already", nlog.Data{"id_str": id, "state": myTask.State})
+			return
+		}
+		myTask.State = task.Cancelled
+		myTask.Error = reason
+		if data, err = json.Marshal(myTask); err != nil {
+			log.Error("Couldn't cancel task", nlog.Data{"err": err, "id_str": id})
+			return
+		}
+
+		response, err = http.Post("http://"+databaseLocation+"/setById", "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Error("Couldn't cancel task", nlog.Data{"err": err, "id_str": id})
+			return
+		}
+		data, _ = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode == http.StatusConflict {
+			log.Info("Task changed while cancelling it, retrying", nlog.Data{"id_str": id, "attempt": attempt, "data": string(data)})
+			continue
+		} else if response.StatusCode != http.StatusOK {
+			log.Error("Couldn't cancel task", nlog.Data{"response.StatusCode": response.StatusCode, "data": string(data), "id_str": id})
+			return
+		}
+		log.Info("Cancelled task", nlog.Data{"id_str": id, "reason": reason})
+		return
+	}
+	log.Error("Couldn't cancel task, it kept changing", nlog.Data{"id_str": id, "attempts": maxCancelAttempts})
+}
+
+// notifyWorkers tells the workers about new tasks. The database won't hand
+// out a delayed task before it's due, so there's no point in waking the
+// workers any earlier.
+func (h *Handler) notifyWorkers(notBefore *time.Time, ids ...string) {
+	notify := func() {
+		for _, id := range ids {
+			log.Info("Notifying workers that there is task to be done", nlog.Data{"id_str": id})
+			var result int
+			h.client.Call("Notifier.Notify", id, &result)
+		}
+	}
+
+	if notBefore != nil && time.Until(*notBefore) > 0 {
+		log.Info("Tasks delayed", nlog.Data{"ids": ids, "notBefore": notBefore})
+		time.AfterFunc(time.Until(*notBefore), notify)
+		return
+	}
+	go notify()
+}
+
+// taskSpecFromQuery builds the uploader supplied part of a task from the
+// /new query: "operations" and "renditions" (JSON lists), "format",
+// "quality", "priority", either "notBefore" (RFC 3339) or "delay" (e.g.
+// "2h") to hold the task back until then, "dependsOn" (comma separated ids
+// of the tasks whose result is the input), "tenant" and "idempotencyKey"
+// (also taken from the Idempotency-Key header), to get the same task back
+// when submitting it again.
+func taskSpecFromQuery(values url.Values) (task.Task, error) {
+	spec := task.Task{}
+
+	operations, err := task.ParseOperations([]byte(values.Get("operations")))
+	if err != nil {
+		return spec, fmt.Errorf("wrong operations: %v", err)
+	}
+	spec.Operations = operations
+
+	renditions, err := task.ParseRenditions([]byte(values.Get("renditions")))
+	if err != nil {
+		return spec, fmt.Errorf("wrong renditions: %v", err)
+	}
+	spec.Renditions = renditions
+
+	if name := values.Get("format"); len(name) != 0 {
+		format, ok := imageformat.ByName(name)
+		if !ok {
+			return spec, fmt.Errorf("unsupported format %q", name)
+		}
+		spec.Format = format.Name
+	}
+
+	if quality := values.Get("quality"); len(quality) != 0 {
+		spec.Quality, err = strconv.Atoi(quality)
+		if err != nil {
+			return spec, fmt.Errorf("wrong quality %q", quality)
+		}
+	}
+
+	if priority := values.Get("priority"); len(priority) != 0 {
+		spec.Priority, err = strconv.Atoi(priority)
+		if err != nil {
+			return spec, fmt.Errorf("wrong priority %q", priority)
+		}
+	}
+
+	spec.Tenant = values.Get("tenant")
+	spec.IdempotencyKey = values.Get("idempotencyKey")
+
+	if dependsOn := values.Get("dependsOn"); len(dependsOn) != 0 {
+		for _, field := range strings.Split(dependsOn, ",") {
+			id, err := task.ParseID(strings.TrimSpace(field))
+			if err != nil {
+				return spec, fmt.Errorf("wrong dependsOn %q, expected comma separated task ids", dependsOn)
+			}
+			spec.DependsOn = append(spec.DependsOn, id)
+		}
+	}
+
+	notBefore, delay := values.Get("notBefore"), values.Get("delay")
+	if len(notBefore) != 0 && len(delay) != 0 {
+		return spec, errors.New("only one of notBefore and delay can be given")
+	} else if len(notBefore) != 0 {
+		at, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return spec, fmt.Errorf("wrong notBefore %q, expected an RFC 3339 time", notBefore)
+		}
+		spec.NotBefore = &at
+	} else if len(delay) != 0 {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return spec, fmt.Errorf("wrong delay %q, expected a duration like 90s or 2h", delay)
+		}
+		at := time.Now().Add(d)
+		spec.NotBefore = &at
+	}
+
+	return spec, spec.ValidateSpec()
 }
 
 func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
+	myTenant, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		fmt.Fprint(w, err)
@@ -112,14 +400,32 @@ func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "Wrong input")
 		return
 	}
+	if tenants != nil {
+		if _, ok := ownTask(w, myTenant, values.Get("id")); !ok {
+			return
+		}
+	}
+
+	query := url.Values{}
+	query.Set("id", values.Get("id"))
+	query.Set("state", "finished")
+	if variant := values.Get("variant"); len(variant) != 0 {
+		query.Set("variant", variant)
+	}
 
-	response, err := http.Get("http://" + storageLocation + "/getImage?id=" + values.Get("id") + "&state=finished")
+	response, err := http.Get("http://" + storageLocation + "/getImage?" + query.Encode())
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
 		return
 	}
 
+	if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+	} else if contentType := response.Header.Get("Content-Type"); len(contentType) != 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+
 	_, err = io.Copy(w, response.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -130,6 +436,11 @@ func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) IsReady(w http.ResponseWriter, r *http.Request) {
+	myTenant, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		fmt.Fprint(w, err)
@@ -141,30 +452,35 @@ func (h *Handler) IsReady(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := http.Get("http://" + databaseLocation + "/getById?id=" + values.Get("id"))
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Error:", err)
-		return
-	}
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		fmt.Println(err)
+	myTask, ok := ownTask(w, myTenant, values.Get("id"))
+	if !ok {
 		return
 	}
 
-	myTask := task.Task{}
-	json.Unmarshal(data, &myTask)
-
-	if myTask.State == 2 {
+	switch myTask.State {
+	case task.Finished:
 		fmt.Fprint(w, "1")
-	} else {
+	case task.Failed:
+		// The reason follows on the next line.
+		fmt.Fprint(w, "2\n", myTask.Error)
+	case task.Cancelled:
+		fmt.Fprint(w, "3")
+	default:
 		fmt.Fprint(w, "0")
 	}
 }
 
 func (h *Handler) GetNewTask(w http.ResponseWriter, r *http.Request) {
-	response, err := http.Post("http://"+databaseLocation+"/getNewTask", "text/plain", nil)
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	query := url.Values{}
+	query.Set("worker", values.Get("worker"))
+
+	response, err := http.Post("http://"+databaseLocation+"/getNewTask?"+query.Encode(), "text/plain", nil)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
@@ -199,13 +515,14 @@ func (h *Handler) RegisterTaskFinished(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := http.Post("http://"+databaseLocation+"/finishTask?id="+values.Get("id"), "test/plain", nil)
+	response, err := http.Post("http://"+databaseLocation+"/finishTask?"+leaseQuery(values), "test/plain", nil)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
 		return
 	}
 
+	w.WriteHeader(response.StatusCode)
 	_, err = io.Copy(w, response.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -215,6 +532,102 @@ func (h *Handler) RegisterTaskFinished(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RegisterTaskFailed reports a failed attempt at a task; the error message
+// is in the request body.
+func (h *Handler) RegisterTaskFailed(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/failTask?"+leaseQuery(values), "text/plain", r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	defer response.Body.Close()
+
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// RenewLease is the heartbeat workers send while processing a task.
+func (h *Handler) RenewLease(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/renewLease?"+leaseQuery(values), "text/plain", nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	defer response.Body.Close()
+
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// SetPriority is the admin call changing the priority of a task that's
+// still waiting or being processed.
+func (h *Handler) SetPriority(w http.ResponseWriter, r *http.Request) {
+	if !authenticateAdmin(w, r) {
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	if len(values.Get("id")) == 0 || len(values.Get("priority")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Wrong input")
+		return
+	}
+
+	query := url.Values{}
+	query.Set("id", values.Get("id"))
+	query.Set("priority", values.Get("priority"))
+
+	response, err := http.Post("http://"+databaseLocation+"/setPriority?"+query.Encode(), "text/plain", nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+	defer response.Body.Close()
+
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// leaseQuery passes on the task id and lease token a worker sent.
+func leaseQuery(values url.Values) string {
+	query := url.Values{}
+	query.Set("id", values.Get("id"))
+	query.Set("token", values.Get("token"))
+	return query.Encode()
+}
+
 func registerInKVStore() bool {
 	if len(os.Args) < 3 {
 		fmt.Println("Error: Too few arguments.")
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// Tenants are read from the JSON file given as the third argument, e.g.
+//
+//	[{"name": "team-a", "key": "...", "maxTasks": 1000, "maxBytes": 10737418240, "maxPriority": 10},
+//	 {"name": "ops", "key": "...", "admin": true}]
+//
+// Every request for tasks then has to carry a tenant's key in the
+// X-Api-Key header. Tasks belong to the tenant that submitted them, and
+// other tenants can't see them. maxTasks limits how many unfinished tasks a
+// tenant has at once, maxBytes how many bytes its images take in storage;
+// 0 means no limit. Tasks are submitted with a priority of at most
+// maxPriority (0 if left out), higher ones are lowered to it. Only admins
+// may change priorities later, of any tenant's tasks, and their own tasks
+// may have any priority.
+//
+// Without the file there's no checking at all, and the "tenant" a task is
+// submitted with is only a label.
+
+type tenant struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	MaxTasks int    `json:"maxTasks"`
+	MaxBytes int64  `json:"maxBytes"`
+
+	MaxPriority int  `json:"maxPriority"`
+	Admin       bool `json:"admin"`
+}
+
+// Tenants by key, nil if tenants aren't configured. Only written on startup.
+var tenants map[string]tenant
+
+func loadTenants(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	list := []tenant{}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("reading tenants: %v", err)
+	}
+
+	tenants = make(map[string]tenant, len(list))
+	names := make(map[string]bool, len(list))
+	for _, t := range list {
+		if len(t.Name) == 0 || len(t.Key) == 0 || t.MaxTasks < 0 || t.MaxBytes < 0 {
+			return fmt.Errorf("tenant %q needs a name, a key and limits that aren't negative", t.Name)
+		}
+		if t.MaxPriority < task.MinPriority || t.MaxPriority > task.MaxPriority {
+			return fmt.Errorf("tenant %q has maxPriority out of range [%v, %v]", t.Name, task.MinPriority, task.MaxPriority)
+		}
+		if err = (task.Task{Tenant: t.Name}).ValidateSpec(); err != nil {
+			return err
+		}
+		if _, ok := tenants[t.Key]; ok || names[t.Name] {
+			return fmt.Errorf("tenant %q or its key is configured twice", t.Name)
+		}
+		tenants[t.Key] = t
+		names[t.Name] = true
+	}
+
+	log.Info("Tenants loaded", nlog.Data{"tenants": len(tenants)})
+	return nil
+}
+
+// authenticate returns the tenant r comes from. If it can't tell, it
+// answers r itself and returns false. Without tenants configured every
+// request comes from the anonymous tenant, which has no limits.
+func authenticate(w http.ResponseWriter, r *http.Request) (tenant, bool) {
+	if tenants == nil {
+		return tenant{}, true
+	}
+
+	t, ok := tenants[r.Header.Get("X-Api-Key")]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Error: Missing or unknown X-Api-Key")
+		return t, false
+	}
+	return t, true
+}
+
+// ownTask looks up task id on behalf of tenant t. Tasks of other tenants
+// are answered with 404, like tasks that don't exist, and so are answered
+// errors; it returns false then.
+func ownTask(w http.ResponseWriter, t tenant, id string) (task.Task, bool) {
+	myTask := task.Task{}
+
+	response, err := http.Get("http://" + databaseLocation + "/getById?id=" + url.QueryEscape(id))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return myTask, false
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return myTask, false
+	}
+
+	if response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		fmt.Fprint(w, string(data))
+		return myTask, false
+	}
+
+	if err = json.Unmarshal(data, &myTask); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "Error:", err)
+		return myTask, false
+	}
+
+	if tenants != nil && myTask.Tenant != t.Name {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Error: No such task")
+		return myTask, false
+	}
+	return myTask, true
+}
+
+// assignTenant makes spec belong to tenant t, lowering its priority to the
+// most t may use. Naming another tenant is answered with 403 and returns
+// false.
+func assignTenant(w http.ResponseWriter, spec *task.Task, t tenant) bool {
+	if tenants == nil {
+		return true
+	}
+	if len(spec.Tenant) != 0 && spec.Tenant != t.Name {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Error: Can't submit tasks for tenant %q", spec.Tenant)
+		return false
+	}
+	spec.Tenant = t.Name
+	if !t.Admin && spec.Priority > t.MaxPriority {
+		spec.Priority = t.MaxPriority
+	}
+	return true
+}
+
+// authenticateAdmin is authenticate for admin calls: the tenant has to be an
+// admin, otherwise 403 is answered and it returns false.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request) bool {
+	t, ok := authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if tenants != nil && !t.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Error: Only admins may do that")
+		return false
+	}
+	return true
+}
+
+// tasksQuery is the query passing the limit on unfinished tasks of t to the
+// database.
+func tasksQuery(t tenant) string {
+	if t.MaxTasks == 0 {
+		return ""
+	}
+	return "?maxTasks=" + strconv.Itoa(t.MaxTasks)
+}
+
+// checkStorageQuota answers 429 and returns false if the images of tenant t
+// already take all the storage it may use.
+func checkStorageQuota(w http.ResponseWriter, t tenant) bool {
+	if t.MaxBytes == 0 {
+		return true
+	}
+
+	used, err := storageUsage(t.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("Couldn't get storage usage", nlog.Data{"err": err, "tenant": t.Name})
+		return false
+	}
+	if used >= t.MaxBytes {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "Error: Tenant %q uses all of its %v bytes of storage", t.Name, t.MaxBytes)
+		return false
+	}
+	return true
+}
+
+func storageUsage(name string) (int64, error) {
+	response, err := http.Get("http://" + storageLocation + "/usage?tenant=" + url.QueryEscape(name))
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("storage returned HTTP status %v: %s", response.StatusCode, data)
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
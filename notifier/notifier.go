@@ -1,15 +1,15 @@
 package notifier
 
-var Todo chan int
+var Todo chan string
 
 type Notifier struct {
 }
 
 func init() {
-	Todo = make(chan int)
+	Todo = make(chan string)
 }
 
-func (t *Notifier) Notify(id int, reply *int) error {
+func (t *Notifier) Notify(id string, reply *int) error {
 	Todo <- id
 	return nil
 }
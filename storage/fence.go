@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+var (
+	databaseLocation string
+
+	// Results of a task are committed one at a time, under the task's lock.
+	// Locks are dropped once nobody holds or waits for them, guarded by
+	// resultLocksMutex.
+	resultLocks      = make(map[string]*resultLock)
+	resultLocksMutex sync.Mutex
+
+	errStaleToken = errors.New("stale lease token")
+)
+
+type resultLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockResults locks the results of task id and returns the function
+// unlocking them.
+func lockResults(id string) func() {
+	resultLocksMutex.Lock()
+	l, ok := resultLocks[id]
+	if !ok {
+		l = &resultLock{}
+		resultLocks[id] = l
+	}
+	l.users++
+	resultLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		resultLocksMutex.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(resultLocks, id)
+		}
+		resultLocksMutex.Unlock()
+	}
+}
+
+// checkLeaseToken makes sure token belongs to the current lease on task id,
+// so that a worker whose lease expired can't overwrite the result of the
+// worker the task was handed to afterwards. It returns the task's tenant.
+func checkLeaseToken(id string, token int64) (string, error) {
+	current, err := getTask(id)
+	if err != nil {
+		return "", err
+	}
+	if current.State != task.Leased || current.LeaseToken != token {
+		return "", errStaleToken
+	}
+	return current.Tenant, nil
+}
+
+// commitResult moves the result uploaded to tmpPath to path, as
+// commitImage does, and drops the results stored before in other formats.
+// The task may have been handed to another worker while this one was
+// uploading, so the token is checked with the database again, with the
+// task's results locked. A newer lease can only be granted once this one
+// expired, and its results are committed after this one's.
+func commitResult(id string, token int64, tmpPath, path, name, tenant string, size int64) error {
+	unlock := lockResults(id)
+	defer unlock()
+
+	if _, err := checkLeaseToken(id, token); err != nil {
+		return err
+	}
+	if err := commitImage(tmpPath, path, tenant, size, 0); err != nil {
+		return err
+	}
+	removeImages(finishedArea, name, path)
+	return nil
+}
+
+// getTask asks the database for task id.
+func getTask(id string) (task.Task, error) {
+	t := task.Task{}
+
+	response, err := http.Get("http://" + databaseLocation + "/getById?id=" + id)
+	if err != nil {
+		return t, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return t, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return t, fmt.Errorf("database returned HTTP status %v: %s", response.StatusCode, data)
+	}
+
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+func getDatabaseAddress() bool {
+	keyValueStoreAddress := os.Args[2]
+
+	response, err := http.Get("http://" + keyValueStoreAddress + "/get?key=databaseAddress")
+	if err != nil {
+		log.Error("Couldn't get database address", nlog.Data{"err": err})
+		return false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Error("Couldn't get database address", nlog.Data{"response.StatusCode": response.StatusCode})
+		return false
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Error("Couldn't read database address", nlog.Data{"err": err})
+		return false
+	}
+	databaseLocation = string(data)
+
+	if len(databaseLocation) == 0 {
+		log.Errorf("databaseLocation empty (set its address in key value store)")
+		return false
+	}
+	return true
+}
@@ -1,20 +1,41 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pmalek/image_service/imageformat"
+	"github.com/pmalek/image_service/task"
 	"github.com/pmalek/nlog"
 )
 
 type Handler struct{}
 
+// Images are kept in two areas, passed as the "state" query parameter. They
+// aren't task states (see task.State): uploads stay in the working area for
+// the task's whole life, results of leased tasks go to the finished area.
+const (
+	workingArea  = "working"
+	finishedArea = "finished"
+)
+
+// The key value store and the database may not be up yet when storage
+// starts, so reaching them is retried, waiting twice as long after every
+// failure, up to maxStartupBackoff.
+const (
+	minStartupBackoff = 100 * time.Millisecond
+	maxStartupBackoff = 10 * time.Second
+)
+
 var log *nlog.Logger
 
 func init() {
@@ -31,19 +52,36 @@ func init() {
 }
 
 func main() {
-	if !registerInKVStore() {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: Too few arguments.")
 		return
 	}
+	retryWithBackoff(registerInKVStore)
+	retryWithBackoff(getDatabaseAddress)
+	retryWithBackoff(func() bool {
+		if err := loadUsage(); err != nil {
+			log.Error("Couldn't load storage usage", nlog.Data{"err": err})
+			return false
+		}
+		return true
+	})
 
 	h := &Handler{}
 	r := mux.NewRouter()
 	r.HandleFunc("/sendImage", h.ReceiveImage).Methods(http.MethodPost)
 	r.HandleFunc("/getImage", h.ServeImage).Methods(http.MethodGet)
+	r.HandleFunc("/deleteImages", h.DeleteImages).Methods(http.MethodPost)
+	r.HandleFunc("/usage", h.Usage).Methods(http.MethodGet)
 
 	log.Infof("Starting storage server at :3002 ...")
 	http.ListenAndServe(":3002", r)
 }
 
+// ReceiveImage stores the image in the request body. Uploads (to the working
+// area) name the tenant they're for with "tenant" and may limit the bytes
+// its images take with "maxBytes"; going over it is answered with 429.
+// Results (in the finished area) need the lease token of the worker storing
+// them.
 func (h *Handler) ReceiveImage(w http.ResponseWriter, r *http.Request) {
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
@@ -61,32 +99,88 @@ func (h *Handler) ReceiveImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	state := values.Get("state")
-	if state != "working" && state != "finished" {
+	if state != workingArea && state != finishedArea {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", "Wrong input state.")
 		log.Error("", nlog.Data{"values": values})
 		return
 	}
 
-	id := values.Get("id")
-	_, err = strconv.Atoi(id)
+	parsedId, err := task.ParseID(values.Get("id"))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", "Wrong input id.")
-		log.Error("Cannot parse id as a number", nlog.Data{"err": err, "id": id})
+		log.Error("Cannot parse id", nlog.Data{"err": err, "values": values})
 		return
 	}
+	id := string(parsedId)
 
-	file, err := os.Create("/tmp/" + state + "/" + id + ".png")
-	defer file.Close()
+	name, ok := imageName(id, values.Get("variant"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", "Wrong input variant.")
+		log.Error("Wrong variant name", nlog.Data{"values": values})
+		return
+	}
+
+	tenant := values.Get("tenant")
+	maxBytes, err := maxBytesFromQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	var token int64
+	if state == finishedArea {
+		token, err = strconv.ParseInt(values.Get("token"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Error:", "Wrong input token.")
+			log.Error("Cannot parse lease token", nlog.Data{"err": err, "values": values})
+			return
+		}
+
+		tenant, err = checkLeaseToken(id, token)
+		maxBytes = 0
+		if err == errStaleToken {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, "Error:", "Task is not leased with this token.")
+			log.Error("Refused image from a stale lease", nlog.Data{"id": id, "token": token})
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "Error:", err)
+			log.Error("Couldn't check lease token", nlog.Data{"err": err, "id": id})
+			return
+		}
+	}
+
+	body := bufio.NewReader(r.Body)
+	head, _ := body.Peek(512)
+	format, ok := imageformat.Sniff(head)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprint(w, "Error:", "Unsupported image format.")
+		log.Error("Unsupported image format", nlog.Data{"id": id, "contentType": http.DetectContentType(head)})
+		return
+	}
+
+	// Write to a temporary file first so that concurrent uploads for the
+	// same id can't interleave and readers never see half an image.
+	file, err := ioutil.TempFile("/tmp/"+state, ".tmp-"+name+"-")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
 		log.Error("", nlog.Data{"err": err})
 		return
 	}
+	defer os.Remove(file.Name())
 
-	_, err = io.Copy(file, r.Body)
+	size, err := io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", err)
@@ -94,6 +188,30 @@ func (h *Handler) ReceiveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The same id could have been stored before in a different format.
+	path := imagePath(state, name, format)
+	if state == finishedArea {
+		err = commitResult(id, token, file.Name(), path, name, tenant, size)
+	} else if err = commitImage(file.Name(), path, tenant, size, maxBytes); err == nil {
+		removeImages(state, name, path)
+	}
+	if err == errStaleToken {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "Error:", "Task is not leased with this token.")
+		log.Error("Refused image from a lease that went stale during the upload", nlog.Data{"id": id, "token": token})
+		return
+	} else if err == errQuotaExceeded {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Error:", err)
+		log.Info("Refused image over quota", nlog.Data{"id": id, "tenant": tenant, "size": size, "maxBytes": maxBytes})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+
 	fmt.Fprint(w, "success")
 }
 
@@ -113,14 +231,14 @@ func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if values.Get("state") != "working" && values.Get("state") != "finished" {
+	if values.Get("state") != workingArea && values.Get("state") != finishedArea {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", "Wrong input state.")
 		log.Error("", nlog.Data{"values": values})
 		return
 	}
 
-	_, err = strconv.Atoi(values.Get("id"))
+	id, err := task.ParseID(values.Get("id"))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Error:", "Wrong input id.")
@@ -128,7 +246,26 @@ func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := os.Open("/tmp/" + values.Get("state") + "/" + values.Get("id") + ".png")
+	name, ok := imageName(string(id), values.Get("variant"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", "Wrong input variant.")
+		log.Error("Wrong variant name", nlog.Data{"values": values})
+		return
+	}
+
+	path, format, err := findImage(values.Get("state"), name)
+	if os.IsNotExist(err) && values.Get("state") == workingArea && len(values.Get("variant")) == 0 {
+		path, format, err = findParentImage(string(id))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		log.Error("", nlog.Data{"err": err})
+		return
+	}
+
+	file, err := os.Open(path)
 	defer file.Close()
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -137,6 +274,7 @@ func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Content-Type", format.ContentType)
 	_, err = io.Copy(w, file)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -146,11 +284,115 @@ func (h *Handler) ServeImage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func registerInKVStore() bool {
-	if len(os.Args) < 3 {
-		fmt.Println("Error: Too few arguments.")
-		return false
+// DeleteImages removes everything stored for a task: its upload, its result
+// and the result's variants. The database calls it once it purged the task.
+// Deleting images that are already gone succeeds.
+func (h *Handler) DeleteImages(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	parsedId, err := task.ParseID(values.Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", "Wrong input id.")
+		log.Error("Cannot parse id", nlog.Data{"err": err, "values": values})
+		return
+	}
+	id := string(parsedId)
+
+	for _, state := range []string{workingArea, finishedArea} {
+		for _, pattern := range []string{id + ".*", id + "_*"} {
+			matches, _ := filepath.Glob("/tmp/" + state + "/" + pattern)
+			for _, path := range matches {
+				if err = removeImage(path); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, "Error:", err)
+					log.Error("Couldn't delete image", nlog.Data{"err": err, "path": path})
+					return
+				}
+			}
+		}
+	}
+
+	log.Info("Deleted images", nlog.Data{"id": id})
+	fmt.Fprint(w, "success")
+}
+
+// imageName is the file name (without extension) an image is stored under.
+// Variants (renditions) of a task's image are stored next to it as
+// <id>_<variant>.
+func imageName(id, variant string) (string, bool) {
+	if len(variant) == 0 {
+		return id, true
 	}
+	if !task.ValidRenditionName(variant) {
+		return "", false
+	}
+	return id + "_" + variant, true
+}
+
+func imagePath(state, name string, format imageformat.Format) string {
+	return "/tmp/" + state + "/" + name + format.Extension
+}
+
+// findImage looks up the stored image called name in state, whatever format
+// it was saved in.
+func findImage(state, name string) (string, imageformat.Format, error) {
+	matches, err := filepath.Glob("/tmp/" + state + "/" + name + ".*")
+	if err != nil {
+		return "", imageformat.Format{}, err
+	}
+	for _, path := range matches {
+		if format, ok := imageformat.ByExtension(filepath.Ext(path)); ok {
+			return path, format, nil
+		}
+	}
+	return "", imageformat.Format{}, os.ErrNotExist
+}
+
+// findParentImage looks up the input of task id when it wasn't uploaded:
+// the finished image of the first task it depends on.
+func findParentImage(id string) (string, imageformat.Format, error) {
+	t, err := getTask(id)
+	if err != nil {
+		return "", imageformat.Format{}, err
+	}
+	if len(t.DependsOn) == 0 {
+		return "", imageformat.Format{}, os.ErrNotExist
+	}
+	return findImage(finishedArea, string(t.DependsOn[0]))
+}
+
+// removeImages deletes every stored image called name in state except keep.
+func removeImages(state, name, keep string) {
+	matches, _ := filepath.Glob("/tmp/" + state + "/" + name + ".*")
+	for _, path := range matches {
+		if path == keep {
+			continue
+		}
+		if err := removeImage(path); err != nil {
+			log.Error("Couldn't remove stale image", nlog.Data{"err": err, "path": path})
+		}
+	}
+}
+
+// retryWithBackoff calls fn until it succeeds. fn logs its own failures.
+func retryWithBackoff(fn func() bool) {
+	backoff := minStartupBackoff
+	for !fn() {
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+func registerInKVStore() bool {
 	storageAddress := os.Args[1] // The address of itself
 	keyValueStoreAddress := os.Args[2]
 
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pmalek/image_service/task"
+	"github.com/pmalek/nlog"
+)
+
+// Storage keeps track of how many bytes every tenant's images take, to
+// enforce the limit the master passes along with uploads ("maxBytes").
+// Results of tasks count too, but are never refused: work that was accepted
+// gets to finish. The tenant of an image is the tenant of its task; the
+// usage is rebuilt from the stored images and the database on startup.
+
+type storedImage struct {
+	tenant string
+	size   int64
+}
+
+var (
+	// Stored images by path, and the bytes they take per tenant, both
+	// guarded by usageMutex.
+	storedImages = make(map[string]storedImage)
+	usage        = make(map[string]int64)
+	usageMutex   sync.Mutex
+
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// commitImage moves the image uploaded to tmpPath to path, on behalf of
+// tenant, if that keeps its usage within maxBytes (or maxBytes is 0).
+func commitImage(tmpPath, path, tenant string, size, maxBytes int64) error {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	newUsage := usage[tenant] + size
+	if old, ok := storedImages[path]; ok && old.tenant == tenant {
+		newUsage -= old.size
+	}
+	if maxBytes > 0 && newUsage > maxBytes {
+		return errQuotaExceeded
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	forgetImage(path)
+	storedImages[path] = storedImage{tenant: tenant, size: size}
+	usage[tenant] += size
+	return nil
+}
+
+// removeImage deletes the image at path.
+func removeImage(path string) error {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	forgetImage(path)
+	return nil
+}
+
+// forgetImage must be called with usageMutex held.
+func forgetImage(path string) {
+	old, ok := storedImages[path]
+	if !ok {
+		return
+	}
+	delete(storedImages, path)
+	usage[old.tenant] -= old.size
+	if usage[old.tenant] == 0 {
+		delete(usage, old.tenant)
+	}
+}
+
+// Usage answers with the number of bytes the images of "tenant" take.
+func (h *Handler) Usage(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error:", err)
+		return
+	}
+
+	usageMutex.Lock()
+	used := usage[values.Get("tenant")]
+	usageMutex.Unlock()
+
+	fmt.Fprint(w, used)
+}
+
+// loadUsage finds the stored images and asks the database whose they are.
+// Nothing is recorded unless it succeeds, so it may be retried.
+// Images of tasks the database doesn't know (any more) belong to nobody.
+func loadUsage() error {
+	images := make(map[task.ID][]string)
+	for _, state := range []string{workingArea, finishedArea} {
+		paths, err := filepath.Glob("/tmp/" + state + "/*")
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			id, err := task.ParseID(strings.SplitN(name, "_", 2)[0])
+			if err != nil {
+				// Temporary files of uploads cut short, among others.
+				continue
+			}
+			images[id] = append(images[id], path)
+		}
+	}
+
+	ids := make([]task.ID, 0, len(images))
+	for id := range images {
+		ids = append(ids, id)
+	}
+	loaded := make(map[string]storedImage)
+	loadedUsage := make(map[string]int64)
+	for len(ids) != 0 {
+		n := len(ids)
+		if n > maxStatusesBatch {
+			n = maxStatusesBatch
+		}
+		tenants, err := getTenants(ids[:n])
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids[:n] {
+			for _, path := range images[id] {
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				loaded[path] = storedImage{tenant: tenants[id], size: info.Size()}
+				loadedUsage[tenants[id]] += info.Size()
+			}
+		}
+		ids = ids[n:]
+	}
+
+	usageMutex.Lock()
+	storedImages, usage = loaded, loadedUsage
+	usageMutex.Unlock()
+
+	log.Info("Storage usage loaded", nlog.Data{"images": len(loaded), "tenants": len(loadedUsage)})
+	return nil
+}
+
+// The most ids the database looks up in one /statuses call.
+const maxStatusesBatch = 1000
+
+// getTenants asks the database for the tenants of the tasks ids.
+func getTenants(ids []task.ID) (map[task.ID]string, error) {
+	idsJson, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.Post("http://"+databaseLocation+"/statuses", "application/json", bytes.NewReader(idsJson))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("database returned HTTP status %v: %s", response.StatusCode, data)
+	}
+
+	statuses := []struct {
+		Id     task.ID `json:"id"`
+		Tenant string  `json:"tenant"`
+	}{}
+	if err = json.Unmarshal(data, &statuses); err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[task.ID]string, len(statuses))
+	for _, status := range statuses {
+		tenants[status.Id] = status.Tenant
+	}
+	return tenants, nil
+}
+
+// maxBytesFromQuery returns the "maxBytes" limit, 0 if there's none.
+func maxBytesFromQuery(values url.Values) (int64, error) {
+	maxBytesStr := values.Get("maxBytes")
+	if len(maxBytesStr) == 0 {
+		return 0, nil
+	}
+	maxBytes, err := strconv.ParseInt(maxBytesStr, 10, 64)
+	if err != nil || maxBytes < 0 {
+		return 0, fmt.Errorf("wrong maxBytes %q", maxBytesStr)
+	}
+	return maxBytes, nil
+}
@@ -0,0 +1,106 @@
+package task
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ID identifies a task. IDs are ULIDs: a 48 bit millisecond timestamp
+// followed by 80 random bits, written as 26 characters of Crockford's
+// base32. They can't be guessed, need no counter or lock to be generated
+// and sort in the order they were created, to the millisecond.
+//
+// Tasks created before IDs were random have decimal IDs ("0", "1", ...).
+// They're still accepted so that old data stays reachable.
+type ID string
+
+const (
+	idLength = 26
+	idDigits = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+	// The longest legacy decimal ID.
+	maxLegacyIDLength = 19
+)
+
+// NewID returns a new random ID. It's safe to call from many goroutines.
+func NewID() ID {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(40-8*i))
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		// There's no safe way to carry on without randomness.
+		panic(fmt.Sprintf("can't read random bytes: %v", err))
+	}
+
+	// 26 digits hold 130 bits; the top two are always zero. Digits are
+	// filled in from the least significant bit up.
+	var id [idLength]byte
+	for i := 0; i < idLength; i++ {
+		digit := 0
+		for bit := 0; bit < 5; bit++ {
+			pos := 5*i + bit
+			if pos < 128 && b[15-pos/8]>>uint(pos%8)&1 == 1 {
+				digit |= 1 << uint(bit)
+			}
+		}
+		id[idLength-1-i] = idDigits[digit]
+	}
+	return ID(id[:])
+}
+
+// ParseID checks that s is an ID and returns it in its canonical
+// (upper case) form.
+func ParseID(s string) (ID, error) {
+	if len(s) == idLength {
+		s = strings.ToUpper(s)
+		// The first digit only holds 3 bits.
+		if s[0] <= '7' && strings.Trim(s, idDigits) == "" {
+			return ID(s), nil
+		}
+	} else if len(s) != 0 && len(s) <= maxLegacyIDLength {
+		if n, err := strconv.ParseUint(s, 10, 63); err == nil && strconv.FormatUint(n, 10) == s {
+			return ID(s), nil
+		}
+	}
+	return "", fmt.Errorf("wrong task id %q", s)
+}
+
+// Less orders IDs the way they were created: legacy decimal IDs first, by
+// value, then ULIDs. As decimal IDs have no leading zeros and are shorter
+// than ULIDs, ordering by length first does it.
+func (id ID) Less(other ID) bool {
+	if len(id) != len(other) {
+		return len(id) < len(other)
+	}
+	return id < other
+}
+
+// UnmarshalJSON accepts the ID as a string, or a number for data written
+// before IDs were random. An empty string is the ID of a task that wasn't
+// created yet.
+func (id *ID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var number uint64
+		if json.Unmarshal(data, &number) != nil {
+			return fmt.Errorf("wrong task id %s", data)
+		}
+		s = strconv.FormatUint(number, 10)
+	} else if len(s) == 0 {
+		*id = ""
+		return nil
+	}
+
+	parsed, err := ParseID(s)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
@@ -0,0 +1,116 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// State is where a task is in its lifecycle. The numeric values match the
+// plain ints the services used to exchange.
+type State int
+
+const (
+	Queued    State = iota // waiting for a worker
+	Leased                 // handed to a worker, see Task.LeaseToken
+	Finished               // the result is in storage
+	Failed                 // ran out of attempts, see Task.Error
+	Cancelled              // withdrawn before it finished
+	Waiting                // waiting for the tasks it depends on to finish
+)
+
+var stateNames = [...]string{
+	Queued:    "queued",
+	Leased:    "leased",
+	Finished:  "finished",
+	Failed:    "failed",
+	Cancelled: "cancelled",
+	Waiting:   "waiting",
+}
+
+// transitions lists the states every state may move to.
+var transitions = map[State][]State{
+	Queued:    {Leased, Cancelled},
+	Leased:    {Queued, Finished, Failed, Cancelled},
+	Finished:  {},
+	Failed:    {Queued}, // retried by hand
+	Cancelled: {},
+	Waiting:   {Queued, Failed, Cancelled}, // once its parents finish, or one of them doesn't
+}
+
+func (s State) Valid() bool {
+	return s >= Queued && s <= Waiting
+}
+
+// Terminal reports whether no worker will ever pick the task up again on its
+// own.
+func (s State) Terminal() bool {
+	return s == Finished || s == Failed || s == Cancelled
+}
+
+func (s State) String() string {
+	if !s.Valid() {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// CanTransitionTo reports whether a task may move from s to next.
+func (s State) CanTransitionTo(next State) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseState returns the state called name.
+func ParseState(name string) (State, error) {
+	for s, n := range stateNames {
+		if n == name {
+			return State(s), nil
+		}
+	}
+	return Queued, fmt.Errorf("unknown state %q", name)
+}
+
+func (s State) MarshalJSON() ([]byte, error) {
+	if !s.Valid() {
+		return nil, fmt.Errorf("unknown state %d", int(s))
+	}
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON accepts the state's name, or its number for clients still
+// sending those.
+func (s *State) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var number int
+		if json.Unmarshal(data, &number) != nil {
+			return fmt.Errorf("wrong state %s", data)
+		}
+		if !State(number).Valid() {
+			return fmt.Errorf("unknown state %d", number)
+		}
+		*s = State(number)
+		return nil
+	}
+
+	state, err := ParseState(name)
+	if err != nil {
+		return err
+	}
+	*s = state
+	return nil
+}
+
+// SetState moves t to next, refusing transitions the state machine doesn't
+// allow.
+func (t *Task) SetState(next State) error {
+	if !t.State.CanTransitionTo(next) {
+		return fmt.Errorf("task %v can't go from %v to %v", t.Id, t.State, next)
+	}
+	t.State = next
+	return nil
+}
@@ -1,6 +1,239 @@
 package task
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	MinPriority = -100
+	MaxPriority = 100
+
+	// Limits of the worker's "resize" operation: neither side of the result
+	// may be larger than MaxResizeDimension, and the result may have at most
+	// MaxResizePixels pixels.
+	MaxResizeDimension = 16384
+	MaxResizePixels    = 1 << 25
+)
+
 type Task struct {
-	Id    int `json:"id"`
-	State int `json:"state"`
+	Id         ID          `json:"id"`
+	State      State       `json:"state"`
+	Operations []Operation `json:"operations,omitempty"`
+
+	// Output format of the finished image ("png", "jpeg", "gif"). Empty means
+	// the format the image was uploaded in.
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+
+	// Extra outputs produced from the finished image, e.g. thumbnails.
+	Renditions []Rendition `json:"renditions,omitempty"`
+
+	// Tasks of higher priority are handed out first, within [MinPriority,
+	// MaxPriority]. Waiting tasks slowly gain priority so they don't starve.
+	Priority int `json:"priority,omitempty"`
+
+	// The task isn't handed out before this time, if set.
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+
+	// Ids of the tasks this one depends on. It waits until all of them are
+	// finished, and its input is the finished image of the first one instead
+	// of an upload.
+	DependsOn []ID `json:"dependsOn,omitempty"`
+
+	// Who the task belongs to, if anyone.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Chosen by the uploader to make submitting the task idempotent: a task
+	// submitted again with the same key (and tenant) isn't created twice.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Kept by the database for tasks with an idempotency key: a hash of the
+	// spec the task was submitted with, and whether its image was stored.
+	// Submitting the key again only gets the task back if both hold.
+	SpecHash    string `json:"specHash,omitempty"`
+	ImageStored bool   `json:"imageStored,omitempty"`
+
+	// Set on tasks handed out by /getNewTask: how long the worker may hold
+	// the task without renewing its lease.
+	LeaseTTL time.Duration `json:"leaseTTL,omitempty"`
+
+	// Fencing token of the latest lease on the task. Every lease gets a
+	// bigger token than any before it, and finishing the task (or storing
+	// its result) requires the token of the current lease.
+	LeaseToken int64 `json:"leaseToken,omitempty"`
+
+	// How many times the task was handed to a worker, and why the last
+	// attempt failed.
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Lifecycle, kept by the database. Worker is whoever leased the task
+	// last. History lists every state change, oldest first.
+	CreatedAt  *time.Time   `json:"createdAt,omitempty"`
+	LeasedAt   *time.Time   `json:"leasedAt,omitempty"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Worker     string       `json:"worker,omitempty"`
+	History    []Transition `json:"history,omitempty"`
+
+	// Goes up by one every time the task is stored. Changing a task by
+	// hand requires the version it was read at, so that other changes made
+	// in between aren't overwritten.
+	Version int64 `json:"version,omitempty"`
+}
+
+// Transition records a task changing state. The first entry of a task's
+// history, its creation, goes from the state it started in to itself.
+type Transition struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	At     time.Time `json:"at"`
+	Worker string    `json:"worker,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Rendition is a named variant of the finished image, made by running
+// Operations on it. It's stored and served next to the main image under
+// its name.
+type Rendition struct {
+	Name       string      `json:"name"`
+	Operations []Operation `json:"operations"`
+}
+
+// Operation names an image operation the worker should run, together with
+// its parameters (e.g. "angle", "size", "quality"). Parameters are kept as
+// strings; it's up to the worker to interpret them.
+type Operation struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// ParseOperations decodes a JSON list of operations. Empty input means no
+// operations were requested.
+func ParseOperations(data []byte) ([]Operation, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	operations := []Operation{}
+	if err := json.Unmarshal(data, &operations); err != nil {
+		return nil, err
+	}
+	if err := validateOperations(operations); err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+// ParseRenditions decodes a JSON list of renditions. Empty input means no
+// renditions were requested.
+func ParseRenditions(data []byte) ([]Rendition, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	renditions := []Rendition{}
+	if err := json.Unmarshal(data, &renditions); err != nil {
+		return nil, err
+	}
+	if err := validateRenditions(renditions); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
+
+// ValidRenditionName reports whether name can be used for a rendition. Names
+// end up in file names, so only letters, digits, '-' and '_' are allowed.
+func ValidRenditionName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Spec returns a copy of t holding only the fields supplied by the uploader.
+func (t Task) Spec() Task {
+	return Task{
+		Operations: t.Operations,
+		Format:     t.Format,
+		Quality:    t.Quality,
+		Renditions: t.Renditions,
+		Priority:   t.Priority,
+		NotBefore:  t.NotBefore,
+		DependsOn:  t.DependsOn,
+		Tenant:     t.Tenant,
+
+		IdempotencyKey: t.IdempotencyKey,
+	}
+}
+
+// ValidateSpec checks the parts of a task that are supplied by the uploader.
+func (t Task) ValidateSpec() error {
+	if t.Quality < 0 || t.Quality > 100 {
+		return errors.New("quality out of range [0, 100]")
+	}
+	if t.Priority < MinPriority || t.Priority > MaxPriority {
+		return fmt.Errorf("priority out of range [%v, %v]", MinPriority, MaxPriority)
+	}
+	if len(t.Tenant) > 64 {
+		return errors.New("tenant name longer than 64 characters")
+	}
+	if len(t.IdempotencyKey) > 255 {
+		return errors.New("idempotency key longer than 255 characters")
+	}
+	if err := validateDependencies(t.DependsOn); err != nil {
+		return err
+	}
+	if err := validateOperations(t.Operations); err != nil {
+		return err
+	}
+	return validateRenditions(t.Renditions)
+}
+
+func validateDependencies(ids []ID) error {
+	seen := make(map[ID]bool)
+	for _, id := range ids {
+		if _, err := ParseID(string(id)); err != nil {
+			return err
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate parent task %v", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func validateRenditions(renditions []Rendition) error {
+	seen := make(map[string]bool)
+	for _, rendition := range renditions {
+		if !ValidRenditionName(rendition.Name) {
+			return fmt.Errorf("wrong rendition name %q", rendition.Name)
+		}
+		if seen[rendition.Name] {
+			return fmt.Errorf("duplicate rendition %q", rendition.Name)
+		}
+		seen[rendition.Name] = true
+
+		if err := validateOperations(rendition.Operations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateOperations(operations []Operation) error {
+	for _, op := range operations {
+		if len(op.Name) == 0 {
+			return errors.New("operation without a name")
+		}
+	}
+	return nil
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The largest side of a kernel given by a task. Every pixel costs
+	// Width*Height multiply-adds per channel.
+	maxKernelSize = 31
+
+	// The largest blur radius. Blurs are done in two passes of 2*radius+1
+	// multiply-adds each, so they can be far bigger.
+	maxBlurRadius = 100
+)
+
+type edgeMode int
+
+const (
+	edgeClamp edgeMode = iota
+	edgeWrap
+	edgeMirror
+)
+
+var edgeModes = map[string]edgeMode{
+	"clamp":  edgeClamp,
+	"wrap":   edgeWrap,
+	"mirror": edgeMirror,
+}
+
+// Kernel is a Width x Height convolution matrix stored row by row. Both
+// sides must be odd so that the kernel has a centre pixel.
+type Kernel struct {
+	Width  int
+	Height int
+	Values []float64
+}
+
+func init() {
+	RegisterOperation("convolve", convolveOperation)
+	RegisterOperation("gaussian_blur", gaussianBlur)
+	RegisterOperation("unsharp_mask", unsharpMask)
+	RegisterOperation("sobel", sobel)
+	RegisterOperation("emboss", emboss)
+}
+
+func (k Kernel) validate() error {
+	if k.Width%2 == 0 || k.Height%2 == 0 || k.Width < 1 || k.Height < 1 ||
+		k.Width > maxKernelSize || k.Height > maxKernelSize {
+		return fmt.Errorf("wrong kernel size %vx%v, sides must be odd and at most %v", k.Width, k.Height, maxKernelSize)
+	}
+	if len(k.Values) != k.Width*k.Height {
+		return fmt.Errorf("kernel of size %vx%v needs %v values, got %v", k.Width, k.Height, k.Width*k.Height, len(k.Values))
+	}
+	return nil
+}
+
+// convolve applies the kernel to the colour channels of src and returns the
+// raw, unclamped result as R, G, B triples, row by row. Pixels outside of
+// src are taken according to edge.
+func (k Kernel) convolve(src *image.NRGBA, edge edgeMode) []float64 {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	out := make([]float64, width*height*3)
+	if width == 0 || height == 0 {
+		return out
+	}
+
+	rx, ry := k.Width/2, k.Height/2
+	xs := make([]int, width+2*rx)
+	for i := range xs {
+		xs[i] = edgeIndex(i-rx, width, edge) * 4
+	}
+
+	parallelRows(height, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < width; x++ {
+				var r, g, b float64
+				for ky := 0; ky < k.Height; ky++ {
+					row := src.Pix[edgeIndex(y+ky-ry, height, edge)*src.Stride:]
+					weights := k.Values[ky*k.Width : (ky+1)*k.Width]
+					for kx, w := range weights {
+						if w == 0 {
+							continue
+						}
+						p := row[xs[x+kx]:]
+						r += float64(p[0]) * w
+						g += float64(p[1]) * w
+						b += float64(p[2]) * w
+					}
+				}
+				o := out[(y*width+x)*3:]
+				o[0], o[1], o[2] = r, g, b
+			}
+		}
+	})
+	return out
+}
+
+// apply convolves src with the kernel and clamps the result into a new
+// image. Alpha is kept from src.
+func (k Kernel) apply(src *image.NRGBA, edge edgeMode) *image.NRGBA {
+	return planeToImage(src, k.convolve(src, edge), 1, 0)
+}
+
+// edgeIndex maps a possibly out of range coordinate into [0, n).
+func edgeIndex(i, n int, edge edgeMode) int {
+	if i >= 0 && i < n {
+		return i
+	}
+
+	switch edge {
+	case edgeWrap:
+		return ((i % n) + n) % n
+	case edgeMirror:
+		if n == 1 {
+			return 0
+		}
+		period := 2 * (n - 1)
+		i = ((i % period) + period) % period
+		if i >= n {
+			i = period - i
+		}
+		return i
+	}
+
+	if i < 0 {
+		return 0
+	}
+	return n - 1
+}
+
+// planeToImage turns R, G, B triples into an image with the alpha channel of
+// src, computing value*scale + offset for every channel.
+func planeToImage(src *image.NRGBA, plane []float64, scale, offset float64) *image.NRGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			srcRow := src.Pix[y*src.Stride:]
+			dstRow := dst.Pix[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				o := plane[(y*width+x)*3:]
+				p := dstRow[x*4 : x*4+4]
+				p[0] = clampUint8(o[0]*scale + offset)
+				p[1] = clampUint8(o[1]*scale + offset)
+				p[2] = clampUint8(o[2]*scale + offset)
+				p[3] = srcRow[x*4+3]
+			}
+		}
+	})
+	return dst
+}
+
+func edgeParam(params map[string]string) (edgeMode, error) {
+	name := params["edge"]
+	if len(name) == 0 {
+		return edgeClamp, nil
+	}
+	edge, ok := edgeModes[name]
+	if !ok {
+		return edgeClamp, fmt.Errorf("unknown edge mode %q", name)
+	}
+	return edge, nil
+}
+
+// Operations...
+
+// convolveOperation applies a user supplied kernel. "kernel" is a comma
+// separated list of values, row by row; "width" and "height" default to a
+// square kernel. The result is divided by "divisor" (default: the sum of the
+// values, or 1 if that's zero) and "offset" is added.
+func convolveOperation(img image.Image, params map[string]string) (image.Image, error) {
+	kernel := Kernel{}
+	for _, field := range strings.Split(params["kernel"], ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("wrong kernel value %q", field)
+		}
+		kernel.Values = append(kernel.Values, value)
+	}
+
+	side := int(math.Sqrt(float64(len(kernel.Values))))
+	var err error
+	if kernel.Width, err = intParam(params, "width", side); err != nil {
+		return nil, err
+	}
+	if kernel.Height, err = intParam(params, "height", side); err != nil {
+		return nil, err
+	}
+	if err = kernel.validate(); err != nil {
+		return nil, err
+	}
+
+	sum := 0.0
+	for _, v := range kernel.Values {
+		sum += v
+	}
+	if sum == 0 {
+		sum = 1
+	}
+	divisor, err := floatParam(params, "divisor", sum)
+	if err != nil {
+		return nil, err
+	}
+	if divisor == 0 {
+		return nil, fmt.Errorf("divisor can't be zero")
+	}
+	offset, err := floatParam(params, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	edge, err := edgeParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	src := toNRGBA(img)
+	return planeToImage(src, kernel.convolve(src, edge), 1/divisor, offset), nil
+}
+
+// gaussianKernels returns the horizontal and vertical halves of a separable
+// Gaussian kernel of the given radius.
+func gaussianKernels(radius int, sigma float64) (Kernel, Kernel) {
+	values := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range values {
+		x := float64(i - radius)
+		values[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += values[i]
+	}
+	for i := range values {
+		values[i] /= sum
+	}
+
+	return Kernel{Width: len(values), Height: 1, Values: values},
+		Kernel{Width: 1, Height: len(values), Values: values}
+}
+
+func blur(src *image.NRGBA, radius int, sigma float64, edge edgeMode) *image.NRGBA {
+	horizontal, vertical := gaussianKernels(radius, sigma)
+	return vertical.apply(horizontal.apply(src, edge), edge)
+}
+
+// blurParams reads "radius" (pixels, default 2), "sigma" (default radius/2)
+// and "edge" shared by the blur based operations.
+func blurParams(params map[string]string) (int, float64, edgeMode, error) {
+	radius, err := intParam(params, "radius", 2)
+	if err != nil {
+		return 0, 0, edgeClamp, err
+	}
+	if radius < 1 || radius > maxBlurRadius {
+		return 0, 0, edgeClamp, fmt.Errorf("radius %v out of range [1, %v]", radius, maxBlurRadius)
+	}
+	sigma, err := floatParam(params, "sigma", math.Max(float64(radius)/2, 0.5))
+	if err != nil {
+		return 0, 0, edgeClamp, err
+	}
+	if sigma <= 0 {
+		return 0, 0, edgeClamp, fmt.Errorf("sigma must be positive")
+	}
+	edge, err := edgeParam(params)
+	return radius, sigma, edge, err
+}
+
+func gaussianBlur(img image.Image, params map[string]string) (image.Image, error) {
+	radius, sigma, edge, err := blurParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return blur(toNRGBA(img), radius, sigma, edge), nil
+}
+
+// unsharpMask sharpens by adding back "amount" percent (default 100) of the
+// difference between the image and its blurred copy. Differences of at most
+// "threshold" (0..255) are left alone to avoid boosting noise.
+func unsharpMask(img image.Image, params map[string]string) (image.Image, error) {
+	radius, sigma, edge, err := blurParams(params)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := floatParam(params, "amount", 100)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := floatParam(params, "threshold", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	src := toNRGBA(img)
+	blurred := blur(src, radius, sigma, edge)
+	dst := image.NewNRGBA(src.Rect)
+	parallelRows(src.Rect.Dy(), func(minY, maxY int) {
+		for i := minY * src.Stride; i < maxY*src.Stride; i += 4 {
+			for c := 0; c < 3; c++ {
+				orig := float64(src.Pix[i+c])
+				diff := orig - float64(blurred.Pix[i+c])
+				if math.Abs(diff) <= threshold {
+					dst.Pix[i+c] = src.Pix[i+c]
+					continue
+				}
+				dst.Pix[i+c] = clampUint8(orig + diff*amount/100)
+			}
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	})
+	return dst, nil
+}
+
+var (
+	sobelX = Kernel{Width: 3, Height: 3, Values: []float64{
+		-1, 0, 1,
+		-2, 0, 2,
+		-1, 0, 1,
+	}}
+	sobelY = Kernel{Width: 3, Height: 3, Values: []float64{
+		-1, -2, -1,
+		0, 0, 0,
+		1, 2, 1,
+	}}
+	embossKernel = Kernel{Width: 3, Height: 3, Values: []float64{
+		-2, -1, 0,
+		-1, 1, 1,
+		0, 1, 2,
+	}}
+)
+
+// sobel draws the edges of the grayscale image: the brighter a pixel, the
+// stronger the gradient there.
+func sobel(img image.Image, params map[string]string) (image.Image, error) {
+	edge, err := edgeParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	gray := mapPixels(img, grayscale)
+	gx := sobelX.convolve(gray, edge)
+	gy := sobelY.convolve(gray, edge)
+	for i := range gx {
+		gx[i] = math.Hypot(gx[i], gy[i])
+	}
+	return planeToImage(gray, gx, 1, 0), nil
+}
+
+func emboss(img image.Image, params map[string]string) (image.Image, error) {
+	edge, err := edgeParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return embossKernel.apply(toNRGBA(img), edge), nil
+}
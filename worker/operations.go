@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pmalek/image_service/task"
+)
+
+// Operation transforms an image. Params come straight from the task spec,
+// so every operation is responsible for parsing and validating its own.
+type Operation func(img image.Image, params map[string]string) (image.Image, error)
+
+// Pipeline is an ordered list of operations applied one after another.
+type Pipeline []task.Operation
+
+var (
+	// Initialized here rather than in init() so that operations in other
+	// files can register themselves from their own init().
+	operations      = make(map[string]Operation)
+	operationsMutex sync.RWMutex
+
+	// Used when a task does not say what should be done with its image.
+	defaultPipeline = Pipeline{{Name: "channel_swap"}}
+)
+
+func init() {
+	RegisterOperation("channel_swap", channelSwap)
+	RegisterOperation("grayscale", pixelOperation(grayscale))
+	RegisterOperation("invert", pixelOperation(invert))
+	RegisterOperation("sepia", pixelOperation(sepia))
+	RegisterOperation("brightness", brightness)
+	RegisterOperation("contrast", contrast)
+}
+
+// RegisterOperation makes op available to pipelines under name. Registering
+// the same name twice replaces the previous operation.
+func RegisterOperation(name string, op Operation) {
+	operationsMutex.Lock()
+	operations[name] = op
+	operationsMutex.Unlock()
+}
+
+func lookupOperation(name string) (Operation, bool) {
+	operationsMutex.RLock()
+	op, ok := operations[name]
+	operationsMutex.RUnlock()
+	return op, ok
+}
+
+// RegisteredOperations returns the sorted names of all known operations.
+func RegisteredOperations() []string {
+	operationsMutex.RLock()
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	operationsMutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that every step names a registered operation.
+func (p Pipeline) Validate() error {
+	for _, step := range p {
+		if _, ok := lookupOperation(step.Name); !ok {
+			return fmt.Errorf("unknown operation %q", step.Name)
+		}
+	}
+	return nil
+}
+
+// Apply runs every step of the pipeline on img in order.
+func (p Pipeline) Apply(img image.Image) (image.Image, error) {
+	if img == nil {
+		return nil, errors.New("nil image")
+	}
+
+	for _, step := range p {
+		op, ok := lookupOperation(step.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %q", step.Name)
+		}
+
+		out, err := op(img, step.Params)
+		if err != nil {
+			return nil, fmt.Errorf("operation %q: %v", step.Name, err)
+		}
+		img = out
+	}
+
+	return img, nil
+}
+
+// pixelOperation lifts a per-pixel colour function into an Operation.
+func pixelOperation(fn func(c color.NRGBA) color.NRGBA) Operation {
+	return func(img image.Image, params map[string]string) (image.Image, error) {
+		return mapPixels(img, fn), nil
+	}
+}
+
+// mapPixels applies fn to every pixel of img, spreading the rows over all
+// CPUs. The result always has its origin at (0, 0).
+func mapPixels(img image.Image, fn func(c color.NRGBA) color.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRows(bounds.Dy(), func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			row := canvas.Pix[y*canvas.Stride : y*canvas.Stride+bounds.Dx()*4]
+			readRow(img, y, row)
+			for i := 0; i < len(row); i += 4 {
+				c := fn(color.NRGBA{R: row[i], G: row[i+1], B: row[i+2], A: row[i+3]})
+				row[i], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+			}
+		}
+	})
+
+	return canvas
+}
+
+// Operations...
+
+func channelSwap(img image.Image, params map[string]string) (image.Image, error) {
+	channels := params["channels"]
+	if len(channels) == 0 {
+		channels = "rg"
+	}
+
+	if len(channels) != 2 || channels[0] == channels[1] ||
+		!strings.ContainsRune("rgb", rune(channels[0])) || !strings.ContainsRune("rgb", rune(channels[1])) {
+		return nil, fmt.Errorf("wrong channels %q, expected two of r, g, b", channels)
+	}
+
+	a, b := strings.IndexByte("rgb", channels[0]), strings.IndexByte("rgb", channels[1])
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		rgb := [3]uint8{c.R, c.G, c.B}
+		rgb[a], rgb[b] = rgb[b], rgb[a]
+		return color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: c.A}
+	}), nil
+}
+
+func grayscale(c color.NRGBA) color.NRGBA {
+	y := clampUint8(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B))
+	return color.NRGBA{R: y, G: y, B: y, A: c.A}
+}
+
+func invert(c color.NRGBA) color.NRGBA {
+	return color.NRGBA{R: 255 - c.R, G: 255 - c.G, B: 255 - c.B, A: c.A}
+}
+
+func sepia(c color.NRGBA) color.NRGBA {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	return color.NRGBA{
+		R: clampUint8(0.393*r + 0.769*g + 0.189*b),
+		G: clampUint8(0.349*r + 0.686*g + 0.168*b),
+		B: clampUint8(0.272*r + 0.534*g + 0.131*b),
+		A: c.A,
+	}
+}
+
+// brightness shifts every channel by "amount", given in percent (-100..100).
+func brightness(img image.Image, params map[string]string) (image.Image, error) {
+	amount, err := floatParam(params, "amount", 0)
+	if err != nil {
+		return nil, err
+	}
+	if amount < -100 || amount > 100 {
+		return nil, fmt.Errorf("amount %v out of range [-100, 100]", amount)
+	}
+
+	shift := amount * 255 / 100
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clampUint8(float64(c.R) + shift),
+			G: clampUint8(float64(c.G) + shift),
+			B: clampUint8(float64(c.B) + shift),
+			A: c.A,
+		}
+	}), nil
+}
+
+// contrast scales every channel around the mid-grey by "amount", given in
+// percent (-100..100).
+func contrast(img image.Image, params map[string]string) (image.Image, error) {
+	amount, err := floatParam(params, "amount", 0)
+	if err != nil {
+		return nil, err
+	}
+	if amount < -100 || amount > 100 {
+		return nil, fmt.Errorf("amount %v out of range [-100, 100]", amount)
+	}
+
+	factor := (100 + amount) / 100
+	factor *= factor
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clampUint8((float64(c.R)-127.5)*factor + 127.5),
+			G: clampUint8((float64(c.G)-127.5)*factor + 127.5),
+			B: clampUint8((float64(c.B)-127.5)*factor + 127.5),
+			A: c.A,
+		}
+	}), nil
+}
+
+// Helpers...
+
+func floatParam(params map[string]string, key string, def float64) (float64, error) {
+	value, ok := params[key]
+	if !ok || len(value) == 0 {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("wrong value %q for parameter %q", value, key)
+	}
+	return f, nil
+}
+
+func intParam(params map[string]string, key string, def int) (int, error) {
+	value, ok := params[key]
+	if !ok || len(value) == 0 {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("wrong value %q for parameter %q", value, key)
+	}
+	return i, nil
+}
+
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+)
+
+// Bands thinner than this aren't worth a goroutine of their own.
+const minBandRows = 16
+
+// parallelRows splits the rows [0, height) into contiguous bands, one per
+// CPU, and calls fn for every band on its own goroutine. It returns once all
+// bands are done. fn must only write to the rows it was given.
+func parallelRows(height int, fn func(minY, maxY int)) {
+	workers := runtime.NumCPU()
+	if bands := (height + minBandRows - 1) / minBandRows; bands < workers {
+		workers = bands
+	}
+	if workers <= 1 {
+		fn(0, height)
+		return
+	}
+
+	band := (height + workers - 1) / workers
+	wg := sync.WaitGroup{}
+	for minY := 0; minY < height; minY += band {
+		maxY := minY + band
+		if maxY > height {
+			maxY = height
+		}
+
+		wg.Add(1)
+		go func(minY, maxY int) {
+			defer wg.Done()
+			fn(minY, maxY)
+		}(minY, maxY)
+	}
+	wg.Wait()
+}
+
+// readRow writes row y (counted from the top of the image's bounds) of img
+// into dst as non-premultiplied RGBA bytes. The common decoder outputs are
+// read straight from their pixel buffers; anything else goes through At.
+func readRow(img image.Image, y int, dst []uint8) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	y += bounds.Min.Y
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		i := src.PixOffset(bounds.Min.X, y)
+		copy(dst, src.Pix[i:i+width*4])
+
+	case *image.RGBA:
+		i := src.PixOffset(bounds.Min.X, y)
+		for x := 0; x < width; x, i = x+1, i+4 {
+			p, d := src.Pix[i:i+4], dst[x*4:x*4+4]
+			switch a := uint32(p[3]); a {
+			case 0:
+				d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+			case 0xff:
+				copy(d, p)
+			default:
+				// Rounded like color.NRGBAModel, which works on 16 bits.
+				d[0] = uint8(uint32(p[0]) * 0xffff / a >> 8)
+				d[1] = uint8(uint32(p[1]) * 0xffff / a >> 8)
+				d[2] = uint8(uint32(p[2]) * 0xffff / a >> 8)
+				d[3] = uint8(a)
+			}
+		}
+
+	case *image.YCbCr:
+		for x := 0; x < width; x++ {
+			yi := src.YOffset(bounds.Min.X+x, y)
+			ci := src.COffset(bounds.Min.X+x, y)
+			d := dst[x*4 : x*4+4]
+			d[0], d[1], d[2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+			d[3] = 0xff
+		}
+
+	case *image.Gray:
+		i := src.PixOffset(bounds.Min.X, y)
+		for x := 0; x < width; x++ {
+			v := src.Pix[i+x]
+			d := dst[x*4 : x*4+4]
+			d[0], d[1], d[2], d[3] = v, v, v, 0xff
+		}
+
+	default:
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, y)).(color.NRGBA)
+			d := dst[x*4 : x*4+4]
+			d[0], d[1], d[2], d[3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
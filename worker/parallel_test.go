@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+const benchWidth, benchHeight = 2000, 1500
+
+// benchImages are the decoder outputs readRow reads directly, filled with a
+// pattern that has partly transparent pixels where the format allows them.
+func benchImages() map[string]image.Image {
+	rect := image.Rect(0, 0, benchWidth, benchHeight)
+	rgba := image.NewRGBA(rect)
+	nrgba := image.NewNRGBA(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+
+	for y := 0; y < benchHeight; y++ {
+		for x := 0; x < benchWidth; x++ {
+			c := color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: uint8(x * y)}
+			rgba.Set(x, y, c)
+			nrgba.SetNRGBA(x, y, c)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(x ^ y)
+		}
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i), uint8(i>>8)
+	}
+
+	return map[string]image.Image{"RGBA": rgba, "NRGBA": nrgba, "YCbCr": ycbcr}
+}
+
+// mapPixelsAtSet is mapPixels as it was before rows were read directly and
+// spread over the CPUs, to compare against.
+func mapPixelsAtSet(img image.Image, fn func(c color.NRGBA) color.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	canvas := image.NewNRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			canvas.SetNRGBA(x, y, fn(c))
+		}
+	}
+	return canvas
+}
+
+func swapRG(c color.NRGBA) color.NRGBA {
+	c.R, c.G = c.G, c.R
+	return c
+}
+
+func TestReadRow(t *testing.T) {
+	for name, img := range benchImages() {
+		want := mapPixelsAtSet(img, swapRG)
+		got := mapPixels(img, swapRG)
+		for i := range want.Pix {
+			if got.Pix[i] != want.Pix[i] {
+				t.Fatalf("%v: byte %v is %v, want %v", name, i, got.Pix[i], want.Pix[i])
+			}
+		}
+	}
+}
+
+func BenchmarkMapPixels(b *testing.B) {
+	for name, img := range benchImages() {
+		b.Run(name+"/AtSet", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				mapPixelsAtSet(img, swapRG)
+			}
+		})
+		b.Run(name+"/mapPixels", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				mapPixels(img, swapRG)
+			}
+		})
+	}
+}
+
+func BenchmarkReadRow(b *testing.B) {
+	for name, img := range benchImages() {
+		b.Run(name+"/At", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for y := 0; y < benchHeight; y++ {
+					for x := 0; x < benchWidth; x++ {
+						color.NRGBAModel.Convert(img.At(x, y))
+					}
+				}
+			}
+		})
+		b.Run(name+"/readRow", func(b *testing.B) {
+			row := make([]uint8, benchWidth*4)
+			for i := 0; i < b.N; i++ {
+				for y := 0; y < benchHeight; y++ {
+					readRow(img, y, row)
+				}
+			}
+		})
+	}
+}
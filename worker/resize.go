@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/pmalek/image_service/task"
+)
+
+const (
+	// Neither side of a resized image may be larger than this, and it may
+	// have at most maxPixels pixels.
+	maxDimension = task.MaxResizeDimension
+	maxPixels    = task.MaxResizePixels
+)
+
+type resampleFilter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = map[string]resampleFilter{
+	"nearest": {
+		support: 0.5,
+		kernel: func(x float64) float64 {
+			if x >= -0.5 && x < 0.5 {
+				return 1
+			}
+			return 0
+		},
+	},
+	"bilinear": {
+		support: 1,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return 1 - x
+			}
+			return 0
+		},
+	},
+	"lanczos": {
+		support: 3,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 3 {
+				return sinc(x) * sinc(x/3)
+			}
+			return 0
+		},
+	},
+}
+
+func init() {
+	RegisterOperation("resize", resize)
+}
+
+// resize scales the image to "width" x "height". Either side may be left
+// out (or "size" given instead of both) in which case the aspect ratio is
+// kept. "mode" is one of:
+//
+//	fit     - scale to fit inside the box, keeping the aspect ratio (default)
+//	fill    - scale to cover the box, then cut off what sticks out
+//	crop    - cut the box out of the centre without scaling
+//	stretch - scale to exactly the box, ignoring the aspect ratio
+//
+// "filter" picks the resampling filter: nearest, bilinear or lanczos
+// (default).
+func resize(img image.Image, params map[string]string) (image.Image, error) {
+	size, err := intParam(params, "size", 0)
+	if err != nil {
+		return nil, err
+	}
+	width, err := intParam(params, "width", size)
+	if err != nil {
+		return nil, err
+	}
+	height, err := intParam(params, "height", size)
+	if err != nil {
+		return nil, err
+	}
+	if width < 0 || height < 0 || width > maxDimension || height > maxDimension || (width == 0 && height == 0) {
+		return nil, fmt.Errorf("wrong size %vx%v", width, height)
+	}
+	if width*height > maxPixels {
+		return nil, fmt.Errorf("size %vx%v is larger than %v pixels", width, height, maxPixels)
+	}
+
+	filterName := params["filter"]
+	if len(filterName) == 0 {
+		filterName = "lanczos"
+	}
+	filter, ok := resampleFilters[filterName]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %q", filterName)
+	}
+
+	src := toNRGBA(img)
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	if srcW == 0 || srcH == 0 {
+		return src, nil
+	}
+
+	mode := params["mode"]
+	var w, h int
+	switch mode {
+	case "", "fit":
+		w, h = fitSize(srcW, srcH, width, height, math.Min)
+	case "fill":
+		if width == 0 || height == 0 {
+			w, h = fitSize(srcW, srcH, width, height, math.Min)
+		} else {
+			w, h = fitSize(srcW, srcH, width, height, math.Max)
+		}
+	case "crop":
+		if width == 0 {
+			width = srcW
+		}
+		if height == 0 {
+			height = srcH
+		}
+		return cropCenter(src, width, height), nil
+	case "stretch":
+		if width == 0 {
+			width = srcW
+		}
+		if height == 0 {
+			height = srcH
+		}
+		w, h = width, height
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+
+	if w*h > maxPixels {
+		return nil, fmt.Errorf("resizing %vx%v to %vx%v gives more than %v pixels", srcW, srcH, w, h, maxPixels)
+	}
+	dst := resample(src, w, h, filter)
+	if mode == "fill" && width != 0 && height != 0 {
+		return cropCenter(dst, width, height), nil
+	}
+	return dst, nil
+}
+
+// fitSize scales srcW x srcH by a single factor so that it matches the
+// width x height box. pick chooses between the horizontal and vertical
+// factor: math.Min fits inside the box, math.Max covers it. A zero side of
+// the box is unconstrained.
+func fitSize(srcW, srcH, width, height int, pick func(a, b float64) float64) (int, int) {
+	scaleX := float64(width) / float64(srcW)
+	scaleY := float64(height) / float64(srcH)
+
+	var scale float64
+	switch {
+	case width == 0:
+		scale = scaleY
+	case height == 0:
+		scale = scaleX
+	default:
+		scale = pick(scaleX, scaleY)
+	}
+
+	w := int(math.Max(1, math.Min(maxDimension, math.Round(float64(srcW)*scale))))
+	h := int(math.Max(1, math.Min(maxDimension, math.Round(float64(srcH)*scale))))
+	return w, h
+}
+
+func cropCenter(src *image.NRGBA, width, height int) *image.NRGBA {
+	if width > src.Rect.Dx() {
+		width = src.Rect.Dx()
+	}
+	if height > src.Rect.Dy() {
+		height = src.Rect.Dy()
+	}
+
+	x := src.Rect.Min.X + (src.Rect.Dx()-width)/2
+	y := src.Rect.Min.Y + (src.Rect.Dy()-height)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Rect, src, image.Pt(x, y), draw.Src)
+	return dst
+}
+
+type resampleWeight struct {
+	index  int
+	weight float64
+}
+
+// resampleWeights computes, for every destination pixel along one axis, the
+// source pixels contributing to it and their normalized weights.
+func resampleWeights(srcSize, dstSize int, filter resampleFilter) [][]resampleWeight {
+	scale := float64(srcSize) / float64(dstSize)
+	stretch := math.Max(scale, 1) // widen the kernel when shrinking
+	radius := math.Ceil(filter.support * stretch)
+
+	weights := make([][]resampleWeight, dstSize)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		from := int(math.Ceil(center - radius))
+		to := int(math.Floor(center + radius))
+
+		sum := 0.0
+		row := make([]resampleWeight, 0, to-from+1)
+		for j := from; j <= to; j++ {
+			w := filter.kernel((float64(j) - center) / stretch)
+			if w == 0 {
+				continue
+			}
+			index := j
+			if index < 0 {
+				index = 0
+			} else if index >= srcSize {
+				index = srcSize - 1
+			}
+			row = append(row, resampleWeight{index: index, weight: w})
+			sum += w
+		}
+
+		if sum == 0 {
+			// Can only happen for the nearest filter when upscaling; take the
+			// closest source pixel.
+			index := int(math.Min(math.Max(math.Round(center), 0), float64(srcSize-1)))
+			row = append(row[:0], resampleWeight{index: index, weight: 1})
+			sum = 1
+		}
+		for k := range row {
+			row[k].weight /= sum
+		}
+		weights[i] = row
+	}
+	return weights
+}
+
+// resample scales src to width x height with a separable filter, first
+// horizontally and then vertically. Colours are weighted by alpha so that
+// transparent pixels don't bleed into their neighbours.
+//
+// Only a few rows are kept scaled horizontally at a time, not the whole
+// image: enough source rows for one destination row when enlarging, and
+// the destination rows still being summed up when shrinking.
+func resample(src *image.NRGBA, width, height int, filter resampleFilter) *image.NRGBA {
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	xWeights := resampleWeights(srcW, width, filter)
+	yWeights := resampleWeights(srcH, height, filter)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	if height >= srcH {
+		parallelRows(height, func(minY, maxY int) {
+			enlargeRows(src, dst, xWeights, yWeights[minY:maxY], minY, filter)
+		})
+	} else {
+		parallelRows(height, func(minY, maxY int) {
+			shrinkRows(src, dst, xWeights, yWeights[minY:maxY], minY)
+		})
+	}
+	return dst
+}
+
+// resampleRow scales source row y horizontally into out, as alpha weighted
+// R, G, B, A sums.
+func resampleRow(src *image.NRGBA, y int, xWeights [][]resampleWeight, out []float64) {
+	srcRow := src.Pix[y*src.Stride:]
+	for x, row := range xWeights {
+		var r, g, b, a float64
+		for _, w := range row {
+			p := srcRow[w.index*4 : w.index*4+4]
+			alpha := float64(p[3]) * w.weight
+			r += float64(p[0]) * alpha
+			g += float64(p[1]) * alpha
+			b += float64(p[2]) * alpha
+			a += alpha
+		}
+		o := out[x*4:]
+		o[0], o[1], o[2], o[3] = r, g, b, a
+	}
+}
+
+// enlargeRows fills the destination rows from minY on, each from the
+// horizontally scaled source rows it needs. Those are cached in a ring big
+// enough for one destination row; as rows move down the source in order,
+// every source row is mostly scaled only once.
+func enlargeRows(src, dst *image.NRGBA, xWeights, yWeights [][]resampleWeight, minY int, filter resampleFilter) {
+	width := dst.Rect.Dx()
+	size := 2*int(math.Ceil(filter.support)) + 2
+	cache := make([]float64, size*width*4)
+	cached := make([]int, size)
+	for i := range cached {
+		cached[i] = -1
+	}
+
+	acc := make([]float64, width*4)
+	for i, row := range yWeights {
+		for k := range acc {
+			acc[k] = 0
+		}
+		for _, w := range row {
+			slot := w.index % size
+			scaled := cache[slot*width*4 : (slot+1)*width*4]
+			if cached[slot] != w.index {
+				resampleRow(src, w.index, xWeights, scaled)
+				cached[slot] = w.index
+			}
+			for k, v := range scaled {
+				acc[k] += v * w.weight
+			}
+		}
+		storeRow(dst, minY+i, acc)
+	}
+}
+
+// shrinkRows fills the destination rows from minY on by going down the
+// source rows they need once, adding every scaled source row to the
+// destination rows it contributes to. A destination row is stored as soon
+// as it has all of its source rows.
+func shrinkRows(src, dst *image.NRGBA, xWeights, yWeights [][]resampleWeight, minY int) {
+	if len(yWeights) == 0 {
+		return
+	}
+	width := dst.Rect.Dx()
+
+	// Rows are opened once the source reaches the first row any of the rest
+	// need; weights of zero are left out, so first rows aren't quite in
+	// order.
+	openAt := make([]int, len(yWeights))
+	last := 0
+	for i := len(yWeights) - 1; i >= 0; i-- {
+		openAt[i] = yWeights[i][0].index
+		if i+1 < len(yWeights) && openAt[i+1] < openAt[i] {
+			openAt[i] = openAt[i+1]
+		}
+		if end := yWeights[i][len(yWeights[i])-1].index; end > last {
+			last = end
+		}
+	}
+
+	type openRow struct {
+		i   int // index into yWeights
+		k   int // the next of its weights to add
+		acc []float64
+	}
+	open := []openRow{}
+	free := [][]float64{}
+	next := 0
+	scaled := make([]float64, width*4)
+
+	for y := openAt[0]; y <= last; y++ {
+		for ; next < len(yWeights) && openAt[next] <= y; next++ {
+			acc := make([]float64, width*4)
+			if n := len(free); n != 0 {
+				acc, free = free[n-1], free[:n-1]
+				for k := range acc {
+					acc[k] = 0
+				}
+			}
+			open = append(open, openRow{i: next, acc: acc})
+		}
+
+		resampleRow(src, y, xWeights, scaled)
+		kept := open[:0]
+		for _, row := range open {
+			weights := yWeights[row.i]
+			for ; row.k < len(weights) && weights[row.k].index == y; row.k++ {
+				for k, v := range scaled {
+					row.acc[k] += v * weights[row.k].weight
+				}
+			}
+			if row.k < len(weights) {
+				kept = append(kept, row)
+				continue
+			}
+			storeRow(dst, minY+row.i, row.acc)
+			free = append(free, row.acc)
+		}
+		open = kept
+	}
+}
+
+// storeRow writes the alpha weighted sums in acc to row y of dst.
+func storeRow(dst *image.NRGBA, y int, acc []float64) {
+	dstRow := dst.Pix[y*dst.Stride:]
+	for x := 0; x < dst.Rect.Dx(); x++ {
+		t := acc[x*4 : x*4+4]
+		p := dstRow[x*4 : x*4+4]
+		if t[3] <= 0 {
+			p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+			continue
+		}
+		p[0] = clampUint8(t[0] / t[3])
+		p[1] = clampUint8(t[1] / t[3])
+		p[2] = clampUint8(t[2] / t[3])
+		p[3] = clampUint8(t[3])
+	}
+}
+
+// toNRGBA returns img as an *image.NRGBA whose bounds start at (0, 0),
+// converting it if needed.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	parallelRows(bounds.Dy(), func(minY, maxY int) {
+		for y := minY; y < maxY; y++ {
+			readRow(img, y, dst.Pix[y*dst.Stride:y*dst.Stride+bounds.Dx()*4])
+		}
+	})
+	return dst
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
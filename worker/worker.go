@@ -4,29 +4,37 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"image"
-	"image/color"
-	"image/png"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/rpc"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pmalek/image_service/imageformat"
 	"github.com/pmalek/image_service/notifier"
 	"github.com/pmalek/image_service/task"
 	"github.com/pmalek/nlog"
 )
 
 var (
+	workerId             string
 	masterLocation       string
 	storageLocation      string
 	keyValueStoreAddress string
 	log                  *nlog.Logger
+
+	// How long a task may be worked on. The lease isn't renewed after that,
+	// so the database hands the task to someone else once it expires.
+	taskDeadline time.Duration
 )
 
 func init() {
@@ -42,15 +50,29 @@ func init() {
 	log.SetOut(multi)
 }
 
+// Marks a poll of master that wasn't triggered by a notification.
+const pollTask = ""
+
 func main() {
-	if len(os.Args) < 2 {
+	concurrency := flag.Int("concurrency", runtime.NumCPU(), "number of tasks processed at the same time")
+	queueSize := flag.Int("queue", 1000, "number of notifications kept while all processing slots are busy")
+	pollInterval := flag.Duration("poll", 5*time.Second, "how often an idle worker asks master for tasks on its own")
+	flag.StringVar(&workerId, "id", defaultWorkerId(), "name of this worker in task histories")
+	flag.DurationVar(&taskDeadline, "deadline", 10*time.Minute, "how long a task may be processed before its lease isn't renewed any more")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Println("Error: Too few arguments.")
 		return
 	}
+	if *concurrency < 1 || *queueSize < 1 || *pollInterval <= 0 || taskDeadline <= 0 {
+		fmt.Println("Error: -concurrency, -queue, -poll and -deadline must be positive.")
+		return
+	}
 
 	//defer profile.Start().Stop()
 
-	keyValueStoreAddress = os.Args[1]
+	keyValueStoreAddress = flag.Arg(0)
 
 	if ok := getSlavesAddressesFromDatabase(); ok == false {
 		log.Errorf("Couldn't get master and/or storage address from key value store")
@@ -66,57 +88,115 @@ func main() {
 	}
 	go http.Serve(l, nil)
 
-	f := func() {
-		neg_task := task.Task{-1, -1}
-
+	// f processes at most one task and reports whether it took one.
+	f := func() bool {
 		myTask, err := getNewTask(masterLocation)
-		if err != nil || myTask == neg_task {
-			return
+		if err != nil || len(myTask.Id) == 0 {
+			return false
 		}
-		myImage, err := getImageFromStorage(storageLocation, myTask)
+		stopHeartbeat := keepLeaseAlive(masterLocation, myTask)
+		defer stopHeartbeat()
+
+		myImage, inputFormat, err := getImageFromStorage(storageLocation, myTask)
 		if err != nil {
-			return
+			return failTask(masterLocation, myTask, err)
 		}
 
-		myImage = doWorkOnImage(myImage)
-
-		err = sendImageToStorage(storageLocation, myTask, myImage)
+		myImage, err = doWorkOnImage(myImage, pipelineForTask(myTask))
 		if err != nil {
-			return
+			return failTask(masterLocation, myTask, err)
 		}
 
-		err = registerFinishedTask(masterLocation, myTask)
+		format := outputFormat(myTask, inputFormat)
+		err = sendImageToStorage(storageLocation, myTask, "", myImage, format)
 		if err != nil {
-			return
+			return failTask(masterLocation, myTask, err)
+		}
+
+		for _, rendition := range myTask.Renditions {
+			renditionImage, err := doWorkOnImage(myImage, Pipeline(rendition.Operations))
+			if err != nil {
+				return failTask(masterLocation, myTask, fmt.Errorf("rendition %q: %v", rendition.Name, err))
+			}
+			err = sendImageToStorage(storageLocation, myTask, rendition.Name, renditionImage, format)
+			if err != nil {
+				return failTask(masterLocation, myTask, err)
+			}
 		}
+
+		// A lost lease or a database that can't be reached both end the
+		// attempt; reporting the failure frees the task right away rather
+		// than when the lease expires.
+		if err = registerFinishedTask(masterLocation, myTask); err != nil {
+			return failTask(masterLocation, myTask, err)
+		}
+		log.Info("Task finished", nlog.Data{"id": myTask.Id})
+		return true
 	}
 
+	// At most *concurrency tasks run at once, each holding a slot. Notifications
+	// that arrive while all slots are busy wait in queue, and nothing is pulled
+	// from master until a slot frees up. Notifications are only hints (the task
+	// itself is kept by the database), so when the queue is full they're
+	// dropped and the task is picked up by a later poll.
+	slots := make(chan struct{}, *concurrency)
+	done := make(chan bool)
+	queue := []string{}
+	poll := time.NewTicker(*pollInterval)
+	defer poll.Stop()
+
 	log.Infof("Launching workers main loop...")
 	for { // worker main loop
+		var freeSlot chan<- struct{}
+		if len(queue) > 0 {
+			freeSlot = slots
+		}
+
 		select {
 		case id := <-notifier.Todo:
+			if len(queue) >= *queueSize {
+				log.Info("Queue full, dropping notification", nlog.Data{"id": id})
+				continue
+			}
+			queue = append(queue, id)
+		case freeSlot <- struct{}{}:
+			id := queue[0]
+			queue = queue[1:]
 			log.Infof("Task to be done... %v", id)
-			go f()
-		case <-time.After(1000 * time.Millisecond):
-			log.Debugf("Hmmm")
+			go func() {
+				tookTask := f()
+				<-slots
+				done <- tookTask
+			}()
+		case tookTask := <-done:
+			// There may be more where that came from.
+			if tookTask && len(queue) == 0 {
+				queue = append(queue, pollTask)
+			}
+		case <-poll.C:
+			// Catch tasks whose notification was dropped or that were
+			// requeued by the database.
+			if len(queue) == 0 && len(slots) < cap(slots) {
+				queue = append(queue, pollTask)
+			}
 		}
 	}
 }
 
 func getNewTask(masterAddress string) (task.Task, error) {
-	response, err := http.Post("http://"+masterAddress+"/getNewTask", "text/plain", nil)
+	response, err := http.Post("http://"+masterAddress+"/getNewTask?worker="+url.QueryEscape(workerId), "text/plain", nil)
 	if err != nil {
 		log.Error("", nlog.Data{"err": err})
-		return task.Task{-1, -1}, errors.New("Error getting new task")
+		return task.Task{}, errors.New("Error getting new task")
 	} else if response.StatusCode == http.StatusNoContent {
 		log.Infof("No task to take...")
-		return task.Task{-1, -1}, nil
+		return task.Task{}, nil
 	}
 
 	data, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		log.Error("", nlog.Data{"err": err})
-		return task.Task{-1, -1}, err
+		return task.Task{}, err
 	}
 
 	log.Info("", nlog.Data{"data": string(data)})
@@ -126,58 +206,71 @@ func getNewTask(masterAddress string) (task.Task, error) {
 	err = json.Unmarshal(data, &myTask)
 	if err != nil {
 		log.Error("", nlog.Data{"err": err})
-		return task.Task{-1, -1}, err
+		return task.Task{}, err
 	}
 
 	return myTask, nil
 }
 
-func getImageFromStorage(storageAddress string, myTask task.Task) (image.Image, error) {
-	response, err := http.Get("http://" + storageAddress + "/getImage?state=working&id=" + strconv.Itoa(myTask.Id))
+func getImageFromStorage(storageAddress string, myTask task.Task) (image.Image, imageformat.Format, error) {
+	response, err := http.Get("http://" + storageAddress + "/getImage?state=working&id=" + string(myTask.Id))
 	if err != nil {
 		log.Error("", nlog.Data{"err": err})
-		return nil, err
+		return nil, imageformat.Format{}, err
 	} else if response.StatusCode == http.StatusNoContent {
 		log.Errorf("http.StatusNoContent")
-		return nil, errors.New("http.StatusNoContent")
+		return nil, imageformat.Format{}, errors.New("http.StatusNoContent")
 	} else if response.StatusCode != http.StatusOK {
 		log.Error("", nlog.Data{"response.StatusCode": response.StatusCode})
-		return nil, nil
+		return nil, imageformat.Format{}, errors.New("Received HTTP status " + strconv.Itoa(response.StatusCode))
 	}
+	defer response.Body.Close()
 
-	myImage, err := png.Decode(response.Body)
+	myImage, format, err := imageformat.Decode(response.Body)
 	if err != nil {
 		log.Error("Problem decoding the image", nlog.Data{"err": err})
-		return nil, err
+		return nil, imageformat.Format{}, err
 	}
 
-	return myImage, nil
+	return myImage, format, nil
 }
 
-func doWorkOnImage(myImage image.Image) image.Image {
+func doWorkOnImage(myImage image.Image, pipeline Pipeline) (image.Image, error) {
 	if myImage == nil {
 		log.Errorf("nil Image")
-		return nil
+		return nil, errors.New("nil Image")
 	}
 
-	myCanvas := image.NewRGBA(myImage.Bounds())
+	result, err := pipeline.Apply(myImage)
+	if err != nil {
+		log.Error("Problem processing the image", nlog.Data{"err": err, "pipeline": pipeline})
+		return nil, err
+	}
 
-	for i := 0; i < myCanvas.Rect.Max.X; i++ {
-		for j := 0; j < myCanvas.Rect.Max.Y; j++ {
-			r, g, b, _ := myImage.At(i, j).RGBA()
-			myColor := new(color.RGBA)
-			myColor.R = uint8(g)
-			myColor.G = uint8(r)
-			myColor.B = uint8(b)
-			myColor.A = uint8(255)
-			myCanvas.Set(i, j, myColor)
-		}
+	return result, nil
+}
+
+// pipelineForTask picks the operations to run for myTask, falling back to
+// the default pipeline when the uploader didn't ask for anything.
+func pipelineForTask(myTask task.Task) Pipeline {
+	if len(myTask.Operations) == 0 {
+		return defaultPipeline
 	}
+	return Pipeline(myTask.Operations)
+}
 
-	return myCanvas.SubImage(myImage.Bounds())
+// outputFormat is the format requested for myTask, or the format the image
+// was uploaded in if none was.
+func outputFormat(myTask task.Task, inputFormat imageformat.Format) imageformat.Format {
+	if format, ok := imageformat.ByName(myTask.Format); ok {
+		return format
+	}
+	return inputFormat
 }
 
-func sendImageToStorage(storageAddress string, myTask task.Task, myImage image.Image) error {
+// sendImageToStorage uploads the finished image of myTask. A non-empty variant
+// stores it as the rendition of that name instead of the main image.
+func sendImageToStorage(storageAddress string, myTask task.Task, variant string, myImage image.Image, format imageformat.Format) error {
 	if myImage == nil {
 		log.Errorf("nil Image")
 		return nil
@@ -185,29 +278,149 @@ func sendImageToStorage(storageAddress string, myTask task.Task, myImage image.I
 
 	data := []byte{}
 	buffer := bytes.NewBuffer(data)
-	err := png.Encode(buffer, myImage)
+	err := imageformat.Encode(buffer, myImage, format, myTask.Quality)
 	if err != nil {
+		log.Error("Problem encoding the image", nlog.Data{"err": err, "format": format.Name})
 		return err
 	}
-	response, err := http.Post("http://"+storageAddress+"/sendImage?state=finished&id="+strconv.Itoa(myTask.Id), "image/png", buffer)
-	if err != nil || response.StatusCode != http.StatusOK {
+	query := leaseQuery(myTask)
+	query.Set("state", "finished")
+	if len(variant) != 0 {
+		query.Set("variant", variant)
+	}
+
+	response, err := http.Post("http://"+storageAddress+"/sendImage?"+query.Encode(), format.ContentType, buffer)
+	if err != nil {
 		return err
+	} else if response.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	} else if response.StatusCode != http.StatusOK {
+		err_str := "Storage refused the image, HTTP status " + strconv.Itoa(response.StatusCode)
+		log.Error(err_str, nlog.Data{"id": myTask.Id, "variant": variant})
+		return errors.New(err_str)
 	}
 
 	return nil
 }
 
 func registerFinishedTask(masterAddress string, myTask task.Task) error {
-	response, err := http.Post("http://"+masterAddress+"/registerTaskFinished?id="+strconv.Itoa(myTask.Id), "test/plain", nil)
-	if err != nil || response.StatusCode != http.StatusOK {
+	response, err := http.Post("http://"+masterAddress+"/registerTaskFinished?"+leaseQuery(myTask).Encode(), "test/plain", nil)
+	if err != nil {
 		return err
 	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	} else if response.StatusCode != http.StatusOK {
+		return errors.New("Received HTTP status " + strconv.Itoa(response.StatusCode))
+	}
 
 	return nil
 }
 
+// failTask reports the failed attempt at myTask to master and returns true,
+// so that f can simply return its result. Nothing is reported when the lease
+// was lost, since the attempt belongs to someone else by now.
+func failTask(masterAddress string, myTask task.Task, reason error) bool {
+	if reason == errLeaseLost {
+		log.Info("Lease lost, abandoning task", nlog.Data{"id": myTask.Id})
+		return true
+	}
+
+	log.Error("Task failed", nlog.Data{"id": myTask.Id, "err": reason})
+	if err := registerFailedTask(masterAddress, myTask, reason); err != nil {
+		log.Error("Couldn't report failed task", nlog.Data{"id": myTask.Id, "err": err})
+	}
+	return true
+}
+
+func registerFailedTask(masterAddress string, myTask task.Task, reason error) error {
+	response, err := http.Post("http://"+masterAddress+"/registerTaskFailed?"+leaseQuery(myTask).Encode(), "text/plain", strings.NewReader(reason.Error()))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	} else if response.StatusCode != http.StatusOK {
+		return errors.New("Received HTTP status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+var errLeaseLost = errors.New("lease lost")
+
+// keepLeaseAlive renews the lease on myTask three times per lease TTL until
+// the returned function is called, until the database refuses to renew it
+// or until taskDeadline has passed.
+func keepLeaseAlive(masterAddress string, myTask task.Task) func() {
+	if myTask.LeaseTTL <= 0 {
+		return func() {}
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(myTask.LeaseTTL / 3)
+		defer ticker.Stop()
+		deadline := time.NewTimer(taskDeadline)
+		defer deadline.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-deadline.C:
+				log.Error("Task took too long, not renewing its lease any more", nlog.Data{"id": myTask.Id, "deadline": taskDeadline})
+				return
+			case <-ticker.C:
+				err := renewLease(masterAddress, myTask)
+				if err == errLeaseLost {
+					log.Error("Lease lost, the task may be handed to another worker", nlog.Data{"id": myTask.Id})
+					return
+				} else if err != nil {
+					log.Error("Couldn't renew lease", nlog.Data{"err": err, "id": myTask.Id})
+				}
+			}
+		}
+	}()
+
+	return func() { close(quit) }
+}
+
+func renewLease(masterAddress string, myTask task.Task) error {
+	response, err := http.Post("http://"+masterAddress+"/renewLease?"+leaseQuery(myTask).Encode(), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	} else if response.StatusCode != http.StatusOK {
+		return errors.New("Received HTTP status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
 // Helpers...
 
+func defaultWorkerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
+
+// leaseQuery identifies myTask and the lease this worker holds on it.
+func leaseQuery(myTask task.Task) url.Values {
+	query := url.Values{}
+	query.Set("id", string(myTask.Id))
+	query.Set("token", strconv.FormatInt(myTask.LeaseToken, 10))
+	return query
+}
+
 func getSlavesAddressesFromDatabase() bool {
 	masterLocation, _ = retrieveFromKeyValueStore("masterAddress")
 	storageLocation, _ = retrieveFromKeyValueStore("storageAddress")